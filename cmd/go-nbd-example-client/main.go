@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"log"
 	"net"
@@ -18,9 +22,45 @@ func main() {
 	name := flag.String("name", "default", "Export name")
 	list := flag.Bool("list", false, "List the exports and exit")
 	blockSize := flag.Uint("block-size", 0, "Block size to use; 0 uses the server's preferred block size")
+	useTLS := flag.Bool("tls", false, "Whether to use TLS")
+	tlsCA := flag.String("tls-ca", "", "Path to CA certificate to verify the server's certificate with (uses the system's CAs if empty)")
+	tlsCert := flag.String("tls-cert", "", "Path to TLS client certificate (enables mutual TLS)")
+	tlsKey := flag.String("tls-key", "", "Path to TLS client key")
+	tlsServerName := flag.String("tls-server-name", "", "Server name to verify the server's certificate against (uses the remote address if empty)")
 
 	flag.Parse()
 
+	var tlsConfig *tls.Config
+	if *useTLS {
+		tlsConfig = &tls.Config{
+			ServerName: *tlsServerName,
+			MinVersion: tls.VersionTLS12,
+		}
+
+		if *tlsCA != "" {
+			ca, err := os.ReadFile(*tlsCA)
+			if err != nil {
+				panic(err)
+			}
+
+			rootCAs := x509.NewCertPool()
+			if !rootCAs.AppendCertsFromPEM(ca) {
+				panic(errors.New("could not parse CA certificate"))
+			}
+
+			tlsConfig.RootCAs = rootCAs
+		}
+
+		if *tlsCert != "" {
+			cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+			if err != nil {
+				panic(err)
+			}
+
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
 	conn, err := net.Dial(*network, *raddr)
 	if err != nil {
 		panic(err)
@@ -30,7 +70,9 @@ func main() {
 	log.Println("Connected to", conn.RemoteAddr())
 
 	if *list {
-		exports, err := client.List(conn)
+		exports, err := client.ListContext(context.Background(), conn, &client.Options{
+			TLSConfig: tlsConfig,
+		})
 		if err != nil {
 			panic(err)
 		}
@@ -48,23 +90,14 @@ func main() {
 	}
 	defer f.Close()
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
-
-	go func() {
-		for range sigCh {
-			if err := client.Disconnect(f); err != nil {
-				panic(err)
-			}
-
-			os.Exit(0)
-		}
-	}()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt) // Cancelling the context disconnects the device
+	defer cancel()
 
-	if err := client.Connect(conn, f, &client.Options{
+	if err := client.ConnectContext(ctx, conn, f, &client.Options{
 		ExportName: *name,
 		BlockSize:  uint32(*blockSize),
-	}); err != nil {
+		TLSConfig:  tlsConfig,
+	}); err != nil && !errors.Is(err, context.Canceled) {
 		panic(err)
 	}
 }
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
 
 	"github.com/pojntfx/go-nbd/pkg/backend"
 	"github.com/pojntfx/go-nbd/pkg/client"
@@ -21,9 +29,60 @@ func main() {
 	preferredBlockSize := flag.Uint("preferred-block-size", client.MaximumBlockSize, "Preferred block size")
 	maximumBlockSize := flag.Uint("maximum-block-size", 0xffffffff, "Maximum block size")
 	multiConn := flag.Bool("multi-conn", true, "Whether to advertise support for multiple simultaneous connections")
+	shutdownTimeout := flag.Duration("shutdown-timeout", time.Minute, "Time to wait for clients to disconnect before forcefully closing their connections")
+	tlsCert := flag.String("tls-cert", "", "Path to TLS certificate (enables TLS)")
+	tlsKey := flag.String("tls-key", "", "Path to TLS key")
+	tlsCA := flag.String("tls-ca", "", "Path to CA certificate to verify client certificates with (enables mutual TLS)")
+	tlsRequired := flag.Bool("tls-required", false, "Whether to reject clients that don't use TLS")
+	metricsLaddr := flag.String("metrics-laddr", "", "Listen address for the Prometheus metrics endpoint (disabled if empty)")
 
 	flag.Parse()
 
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			panic(err)
+		}
+
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+
+		if *tlsCA != "" {
+			ca, err := os.ReadFile(*tlsCA)
+			if err != nil {
+				panic(err)
+			}
+
+			clientCAs := x509.NewCertPool()
+			if !clientCAs.AppendCertsFromPEM(ca) {
+				panic(errors.New("could not parse CA certificate"))
+			}
+
+			tlsConfig.ClientCAs = clientCAs
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	var collector server.Collector
+	if *metricsLaddr != "" {
+		prometheusCollector := server.NewPrometheusCollector()
+		collector = prometheusCollector
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", prometheusCollector)
+
+		go func() {
+			log.Println("Serving metrics on", *metricsLaddr)
+
+			if err := http.ListenAndServe(*metricsLaddr, mux); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
 	l, err := net.Listen(*network, *laddr)
 	if err != nil {
 		panic(err)
@@ -34,50 +93,68 @@ func main() {
 
 	b := backend.NewMemoryBackend(make([]byte, *size))
 
-	clients := 0
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Println("Could not accept connection, continuing:", err)
+	srv := server.NewServer(
+		[]*server.Export{
+			{
+				Name:        *name,
+				Description: *description,
+				Backend:     b,
+			},
+		},
+		&server.Options{
+			ReadOnly:           *readOnly,
+			MinimumBlockSize:   uint32(*minimumBlockSize),
+			PreferredBlockSize: uint32(*preferredBlockSize),
+			MaximumBlockSize:   uint32(*maximumBlockSize),
+			SupportsMultiConn:  *multiConn,
+			TLSConfig:          tlsConfig,
+			TLSRequired:        *tlsRequired,
+			Collector:          collector,
+		},
+		&server.ServerHooks{
+			OnConnect: func(conn net.Conn) {
+				log.Printf("%v connected", conn.RemoteAddr())
+			},
+			OnDisconnect: func(conn net.Conn, err error) {
+				if err != nil {
+					log.Printf("%v disconnected with error: %v", conn.RemoteAddr(), err)
+
+					return
+				}
 
-			continue
-		}
+				log.Printf("%v disconnected", conn.RemoteAddr())
+			},
+		},
+	)
 
-		clients++
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
 
-		log.Printf("%v clients connected", clients)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
 
-		go func() {
-			defer func() {
-				_ = conn.Close()
+		<-sigCh
 
-				clients--
+		log.Println("Shutting down, press CTRL-C again to force")
 
-				if err := recover(); err != nil {
-					log.Printf("Client disconnected with error: %v", err)
-				}
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
 
-				log.Printf("%v clients connected", clients)
-			}()
-
-			if err := server.Handle(
-				conn,
-				[]*server.Export{
-					{
-						Name:        *name,
-						Description: *description,
-						Backend:     b,
-					},
-				},
-				&server.Options{
-					ReadOnly:           *readOnly,
-					MinimumBlockSize:   uint32(*minimumBlockSize),
-					PreferredBlockSize: uint32(*preferredBlockSize),
-					MaximumBlockSize:   uint32(*maximumBlockSize),
-					SupportsMultiConn:  *multiConn,
-				}); err != nil {
-				panic(err)
-			}
+		go func() {
+			<-sigCh
+
+			cancel()
 		}()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Could not shut down gracefully:", err)
+		}
+	}()
+
+	if err := srv.Serve(l); err != nil && !errors.Is(err, server.ErrServerClosed) {
+		panic(err)
 	}
+
+	<-shutdownDone
 }
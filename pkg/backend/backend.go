@@ -1,6 +1,15 @@
 package backend
 
-import "io"
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrUnsupported   = errors.New("unsupported operation")
+	ErrInvalidOffset = errors.New("invalid offset")
+	ErrInvalidSize   = errors.New("invalid size")
+)
 
 type Backend interface {
 	io.ReaderAt
@@ -9,3 +18,73 @@ type Backend interface {
 	Size() (int64, error)
 	Sync() error
 }
+
+type ForceUnitAccessWriter interface {
+	WriteAtFUA(p []byte, off int64) (n int, err error) // Like WriteAt, but the data must be persisted before returning
+}
+
+type Prefetcher interface {
+	Prefetch(off int64, length int64) error // Hints that the region will be read soon, e.g. to fetch it from a remote backend ahead of time
+}
+
+type Trimmer interface {
+	Trim(off int64, length int64) error
+}
+
+type Zeroer interface {
+	Zero(off int64, length int64, noHole bool) error // If noHole is set, the zeroed region must stay allocated; otherwise it may be deallocated
+}
+
+type Resizer interface {
+	Resize(size int64) error
+}
+
+type Extent struct {
+	Length int64
+	Hole   bool // The region is not allocated
+	Zero   bool // The region reads as zeroes
+}
+
+type ExtentReporter interface {
+	Extents(off int64, length int64) ([]Extent, error) // Extents are contiguous, start at off and should not exceed length
+}
+
+type Capabilities struct {
+	ReadOnly   bool // Writes are rejected
+	Rotational bool // Seeks are slow, so clients should prefer sequential access
+	Trim       bool
+	Flush      bool // Writes are cached, so Sync needs to be called to persist them
+	FUA        bool // Writes can be persisted individually; backends that don't implement ForceUnitAccessWriter are synced after the write
+	Cache      bool // Backends that don't implement Prefetcher ignore cache requests
+	Resize     bool
+}
+
+type CapabilityReporter interface {
+	Capabilities() Capabilities
+}
+
+func GetCapabilities(b Backend) Capabilities {
+	var (
+		_, trim   = b.(Trimmer)
+		_, resize = b.(Resizer)
+	)
+
+	reporter, ok := b.(CapabilityReporter)
+	if !ok {
+		return Capabilities{
+			Trim:   trim,
+			Flush:  true,
+			FUA:    true,
+			Cache:  true,
+			Resize: resize,
+		}
+	}
+
+	capabilities := reporter.Capabilities()
+
+	// Backends can only opt out of optional operations that they implement
+	capabilities.Trim = capabilities.Trim && trim
+	capabilities.Resize = capabilities.Resize && resize
+
+	return capabilities
+}
@@ -44,6 +44,13 @@ func (b *FileBackend) Size() (int64, error) {
 	return size, nil
 }
 
+func (b *FileBackend) Resize(size int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.file.Truncate(size)
+}
+
 func (b *FileBackend) Sync() error {
 	return b.file.Sync()
 }
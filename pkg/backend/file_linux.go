@@ -0,0 +1,191 @@
+//go:build linux
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// See /usr/include/linux/falloc.h and /usr/include/linux/fs.h
+
+const (
+	fallocateFlagKeepSize  = 0x01
+	fallocateFlagPunchHole = 0x02
+	fallocateFlagZeroRange = 0x10
+
+	seekData = 3
+	seekHole = 4
+)
+
+func (b *FileBackend) Capabilities() Capabilities {
+	return Capabilities{
+		ReadOnly:   isReadOnly(b.file),
+		Rotational: isRotational(b.file),
+		Trim:       true,
+		Flush:      true,
+		FUA:        true,
+		Cache:      true,
+		Resize:     !isBlockDevice(b.file), // Block devices can't be truncated
+	}
+}
+
+func isBlockDevice(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeDevice != 0
+}
+
+func isReadOnly(file *os.File) bool {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return false
+	}
+
+	return flags&syscall.O_ACCMODE == syscall.O_RDONLY
+}
+
+func isRotational(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	dev := uint64(stat.Dev)
+	if info.Mode()&os.ModeDevice != 0 {
+		dev = uint64(stat.Rdev) // For block devices, we need to check the device itself instead of the filesystem that contains its node
+	}
+
+	var (
+		major = ((dev >> 8) & 0xfff) | ((dev >> 32) & 0xfffff000)
+		minor = (dev & 0xff) | ((dev >> 12) & 0xffffff00)
+	)
+
+	base, err := filepath.EvalSymlinks(filepath.Join("/sys", "dev", "block", fmt.Sprintf("%d:%d", major, minor)))
+	if err != nil {
+		return false // Virtual filesystems such as tmpfs don't have a backing block device
+	}
+
+	for _, candidate := range []string{
+		filepath.Join(base, "queue", "rotational"),
+		filepath.Join(base, "..", "queue", "rotational"), // Partitions don't have a queue of their own
+	} {
+		rotational, err := os.ReadFile(candidate)
+		if err != nil {
+			continue
+		}
+
+		return strings.TrimSpace(string(rotational)) == "1"
+	}
+
+	return false
+}
+
+func (b *FileBackend) WriteAtFUA(p []byte, off int64) (n int, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	n, err = b.file.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+
+	return n, syscall.Fdatasync(int(b.file.Fd())) // Unlike `Sync`, this doesn't flush metadata that isn't required to read the data back
+}
+
+func (b *FileBackend) Trim(off int64, length int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := syscall.Fallocate(int(b.file.Fd()), fallocateFlagKeepSize|fallocateFlagPunchHole, off, length); err != nil {
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			return nil // Trimming is only a hint, so filesystems that can't punch holes can ignore it
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (b *FileBackend) Zero(off int64, length int64, noHole bool) error {
+	mode := uint32(fallocateFlagKeepSize | fallocateFlagPunchHole)
+	if noHole {
+		mode = fallocateFlagKeepSize | fallocateFlagZeroRange
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := syscall.Fallocate(int(b.file.Fd()), mode, off, length); err != nil {
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			return ErrUnsupported // Not all filesystems support zeroing ranges efficiently
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (b *FileBackend) Extents(off int64, length int64) ([]Extent, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	extents := []Extent{}
+	for end := off + length; off < end; {
+		dataStart, err := b.file.Seek(off, seekData)
+		if err != nil {
+			if !errors.Is(err, syscall.ENXIO) {
+				return nil, err
+			}
+
+			dataStart = end // There is no more data after off, so the rest of the region is a hole
+		}
+
+		if dataStart > off {
+			if dataStart > end {
+				dataStart = end
+			}
+
+			extents = append(extents, Extent{
+				Length: dataStart - off,
+				Hole:   true,
+				Zero:   true,
+			})
+
+			off = dataStart
+
+			continue
+		}
+
+		dataEnd, err := b.file.Seek(off, seekHole)
+		if err != nil {
+			return nil, err
+		}
+
+		if dataEnd > end {
+			dataEnd = end
+		}
+
+		extents = append(extents, Extent{
+			Length: dataEnd - off,
+		})
+
+		off = dataEnd
+	}
+
+	return extents, nil
+}
@@ -16,40 +16,99 @@ func NewMemoryBackend(memory []byte) *MemoryBackend {
 
 func (b *MemoryBackend) ReadAt(p []byte, off int64) (n int, err error) {
 	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
 
 	if off >= int64(len(b.memory)) {
 		return 0, io.EOF
 	}
 
-	n = copy(p, b.memory[off:off+int64(len(p))])
+	n = copy(p, b.memory[off:])
 
-	b.lock.Unlock()
+	if n < len(p) {
+		return n, io.EOF
+	}
 
 	return
 }
 
 func (b *MemoryBackend) WriteAt(p []byte, off int64) (n int, err error) {
 	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
 
 	if off >= int64(len(b.memory)) {
 		return 0, io.EOF
 	}
 
-	n = copy(b.memory[off:off+int64(len(p))], p)
+	n = copy(b.memory[off:], p)
 
 	if n < len(p) {
 		return n, io.ErrShortWrite
 	}
 
-	b.lock.Unlock()
-
 	return
 }
 
 func (b *MemoryBackend) Size() (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
 	return int64(len(b.memory)), nil
 }
 
+func (b *MemoryBackend) Resize(size int64) error {
+	if size < 0 {
+		return ErrInvalidSize
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if size <= int64(len(b.memory)) {
+		b.memory = b.memory[:size]
+
+		return nil
+	}
+
+	memory := make([]byte, size) // We can't grow into the existing capacity, since it might still contain data from before we shrunk the memory
+	copy(memory, b.memory)
+
+	b.memory = memory
+
+	return nil
+}
+
 func (b *MemoryBackend) Sync() error {
 	return nil
 }
+
+func (b *MemoryBackend) Trim(off int64, length int64) error {
+	return b.Zero(off, length, false)
+}
+
+func (b *MemoryBackend) Zero(off int64, length int64, noHole bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if off < 0 || length < 0 {
+		return ErrInvalidOffset
+	}
+
+	if off > int64(len(b.memory)) || length > int64(len(b.memory))-off {
+		return io.EOF
+	}
+
+	region := b.memory[off : off+length]
+	for i := range region {
+		region[i] = 0
+	}
+
+	return nil
+}
@@ -2,6 +2,8 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -33,6 +35,8 @@ var (
 	ErrMinimumBlockSize           = errors.New("block size below mimimum requested")
 	ErrMaximumBlockSize           = errors.New("block size above maximum requested")
 	ErrBlockSizeNotPowerOfTwo     = errors.New("block size is not a power of 2")
+	ErrTLSUnsupported             = errors.New("server does not support TLS")
+	ErrTLSRequired                = errors.New("server requires TLS")
 )
 
 type Options struct {
@@ -42,30 +46,88 @@ type Options struct {
 	ReadyCheckUdev         bool
 	ReadyCheckPollInterval time.Duration
 	Timeout                int
+
+	TLSConfig *tls.Config // Set `RootCAs` to verify the server's certificate and `Certificates` to authenticate with a client certificate
 }
 
-func negotiateNewstyle(conn net.Conn) error {
+func negotiateNewstyle(conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
 	var newstyleHeader protocol.NegotiationNewstyleHeader
 	if err := binary.Read(conn, binary.BigEndian, &newstyleHeader); err != nil {
-		return err
+		return nil, err
 	}
 
 	if newstyleHeader.OldstyleMagic != protocol.NEGOTIATION_MAGIC_OLDSTYLE {
-		return server.ErrInvalidMagic
+		return nil, server.ErrInvalidMagic
 	}
 
 	if newstyleHeader.OptionMagic != protocol.NEGOTIATION_MAGIC_OPTION {
-		return server.ErrInvalidMagic
+		return nil, server.ErrInvalidMagic
 	}
 
-	if _, err := conn.Write(make([]byte, 4)); err != nil { // Send client flags (uint32)
-		return err
+	clientFlags := uint32(0)
+	if newstyleHeader.HandshakeFlags&protocol.NEGOTIATION_HANDSHAKE_FLAG_FIXED_NEWSTYLE != 0 {
+		clientFlags |= protocol.NEGOTIATION_CLIENT_FLAG_FIXED_NEWSTYLE
 	}
 
-	return nil
+	if err := binary.Write(conn, binary.BigEndian, clientFlags); err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	return startTLS(conn, tlsConfig)
 }
 
-func Connect(conn net.Conn, device *os.File, options *Options) error {
+func startTLS(conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+	if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationOptionHeader{
+		OptionMagic: protocol.NEGOTIATION_MAGIC_OPTION,
+		ID:          protocol.NEGOTIATION_ID_OPTION_STARTTLS,
+		Length:      0,
+	}); err != nil {
+		return nil, err
+	}
+
+	var replyHeader protocol.NegotiationReplyHeader
+	if err := binary.Read(conn, binary.BigEndian, &replyHeader); err != nil {
+		return nil, err
+	}
+
+	if replyHeader.ReplyMagic != protocol.NEGOTIATION_MAGIC_REPLY {
+		return nil, server.ErrInvalidMagic
+	}
+
+	if _, err := io.CopyN(io.Discard, conn, int64(replyHeader.Length)); err != nil { // Discard the reply's data, such as error messages
+		return nil, err
+	}
+
+	switch replyHeader.Type {
+	case protocol.NEGOTIATION_TYPE_REPLY_ACK:
+	case protocol.NEGOTIATION_TYPE_REPLY_ERR_UNSUPPORTED:
+		return nil, ErrTLSUnsupported
+	default:
+		return nil, ErrUnknownReply
+	}
+
+	if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = host // Verify the certificate against the address we've connected to, like `tls.Dial` does
+		}
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// Negotiate runs the handshake for `options.ExportName` and returns the connection to use for the
+// transmission phase (which is a TLS connection if `options.TLSConfig` is set), the export's size and the block size
+func Negotiate(conn net.Conn, options *Options) (net.Conn, uint64, uint32, error) {
 	if options == nil {
 		options = &Options{}
 	}
@@ -74,28 +136,137 @@ func Connect(conn net.Conn, device *os.File, options *Options) error {
 		options.ExportName = "default"
 	}
 
-	if !options.ReadyCheckUdev && options.ReadyCheckPollInterval <= 0 {
-		options.ReadyCheckPollInterval = time.Millisecond
+	return negotiate(conn, options)
+}
+
+func negotiate(conn net.Conn, options *Options) (net.Conn, uint64, uint32, error) {
+	conn, err := negotiateNewstyle(conn, options.TLSConfig)
+	if err != nil {
+		return nil, 0, 0, err
 	}
 
-	var cfd uintptr
-	switch c := conn.(type) {
-	case *net.TCPConn:
-		file, err := c.File()
-		if err != nil {
-			return err
+	var (
+		exportName          = []byte(options.ExportName)
+		informationRequests = []uint16{protocol.NEGOTIATION_TYPE_INFO_BLOCKSIZE} // We need the block size constraints to configure the device
+	)
+
+	if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationOptionHeader{
+		OptionMagic: protocol.NEGOTIATION_MAGIC_OPTION,
+		ID:          protocol.NEGOTIATION_ID_OPTION_GO,
+		Length:      uint32(4 + len(exportName) + 2 + 2*len(informationRequests)), // Export name length (uint32), export name, information request count (uint16) and information requests (uint16s)
+	}); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if err := binary.Write(conn, binary.BigEndian, uint32(len(exportName))); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if _, err := conn.Write([]byte(exportName)); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if err := binary.Write(conn, binary.BigEndian, uint16(len(informationRequests))); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if err := binary.Write(conn, binary.BigEndian, informationRequests); err != nil {
+		return nil, 0, 0, err
+	}
+
+	size := uint64(0)
+	chosenBlockSize := uint32(1)
+
+n:
+	for {
+		var replyHeader protocol.NegotiationReplyHeader
+		if err := binary.Read(conn, binary.BigEndian, &replyHeader); err != nil {
+			return nil, 0, 0, err
 		}
 
-		cfd = uintptr(file.Fd())
-	case *net.UnixConn:
-		file, err := c.File()
-		if err != nil {
-			return err
+		if replyHeader.ReplyMagic != protocol.NEGOTIATION_MAGIC_REPLY {
+			return nil, 0, 0, server.ErrInvalidMagic
 		}
 
-		cfd = uintptr(file.Fd())
-	default:
-		return ErrUnsupportedNetwork
+		switch replyHeader.Type {
+		case protocol.NEGOTIATION_TYPE_REPLY_INFO:
+			infoRaw := make([]byte, replyHeader.Length)
+			if _, err := io.ReadFull(conn, infoRaw); err != nil {
+				return nil, 0, 0, err
+			}
+
+			var infoType uint16
+			if err := binary.Read(bytes.NewBuffer(infoRaw), binary.BigEndian, &infoType); err != nil {
+				return nil, 0, 0, err
+			}
+
+			switch infoType {
+			case protocol.NEGOTIATION_TYPE_INFO_EXPORT:
+				var info protocol.NegotiationReplyInfo
+				if err := binary.Read(bytes.NewBuffer(infoRaw), binary.BigEndian, &info); err != nil {
+					return nil, 0, 0, err
+				}
+
+				size = info.Size
+			case protocol.NEGOTIATION_TYPE_INFO_NAME:
+				// Discard export name
+			case protocol.NEGOTIATION_TYPE_INFO_DESCRIPTION:
+				// Discard export description
+			case protocol.NEGOTIATION_TYPE_INFO_BLOCKSIZE:
+				var info protocol.NegotiationReplyBlockSize
+				if err := binary.Read(bytes.NewBuffer(infoRaw), binary.BigEndian, &info); err != nil {
+					return nil, 0, 0, err
+				}
+
+				if options.BlockSize == 0 {
+					chosenBlockSize = info.PreferredBlockSize
+				} else if options.BlockSize >= info.MinimumBlockSize && options.BlockSize <= info.MaximumBlockSize {
+					chosenBlockSize = options.BlockSize
+				} else {
+					return nil, 0, 0, ErrUnsupportedServerBlockSize
+				}
+
+				if chosenBlockSize > MaximumBlockSize {
+					return nil, 0, 0, ErrMaximumBlockSize
+				} else if chosenBlockSize < MinimumBlockSize {
+					return nil, 0, 0, ErrMinimumBlockSize
+				}
+
+				if !((chosenBlockSize > 0) && ((chosenBlockSize & (chosenBlockSize - 1)) == 0)) {
+					return nil, 0, 0, ErrBlockSizeNotPowerOfTwo
+				}
+			default:
+				return nil, 0, 0, ErrUnknownInfo
+			}
+		case protocol.NEGOTIATION_TYPE_REPLY_ACK:
+			break n
+		case protocol.NEGOTIATION_TYPE_REPLY_ERR_UNKNOWN:
+			return nil, 0, 0, ErrUnknownErr
+		case protocol.NEGOTIATION_TYPE_REPLY_ERR_TLS_REQD:
+			return nil, 0, 0, ErrTLSRequired
+		default:
+			return nil, 0, 0, ErrUnknownReply
+		}
+	}
+
+	return conn, size, chosenBlockSize, nil
+}
+
+func Connect(conn net.Conn, device *os.File, options *Options) error {
+	return ConnectContext(context.Background(), conn, device, options)
+}
+
+func ConnectContext(ctx context.Context, conn net.Conn, device *os.File, options *Options) error {
+	if options == nil {
+		options = &Options{}
+	}
+
+	if options.ExportName == "" {
+		options.ExportName = "default"
+	}
+
+	if !options.ReadyCheckUdev && options.ReadyCheckPollInterval <= 0 {
+		options.ReadyCheckPollInterval = time.Millisecond
 	}
 
 	fatal := make(chan error)
@@ -179,112 +350,70 @@ func Connect(conn net.Conn, device *os.File, options *Options) error {
 		}
 	}
 
-	if _, _, err := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		device.Fd(),
-		ioctl.NEGOTIATION_IOCTL_SET_SOCK,
-		uintptr(cfd),
-	); err != 0 {
-		return err
-	}
+	var (
+		stop    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
 
-	if err := negotiateNewstyle(conn); err != nil {
-		return err
-	}
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now()) // Abort the negotiation
+		case <-stop:
+		}
+	}()
 
-	if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationOptionHeader{
-		OptionMagic: protocol.NEGOTIATION_MAGIC_OPTION,
-		ID:          protocol.NEGOTIATION_ID_OPTION_GO,
-		Length:      0,
-	}); err != nil {
-		return err
-	}
+	transmissionConn, size, chosenBlockSize, err := negotiate(conn, options)
 
-	exportName := []byte(options.ExportName)
+	close(stop)
+	<-stopped // The deadline must not be set once the connection is in use by the kernel or the TLS proxy
 
-	if err := binary.Write(conn, binary.BigEndian, uint32(len(exportName))); err != nil {
-		return err
-	}
+	if ctx.Err() != nil {
+		_ = conn.Close()
 
-	if _, err := conn.Write([]byte(exportName)); err != nil {
-		return err
+		return ctx.Err()
 	}
 
-	if err := binary.Write(conn, binary.BigEndian, uint16(0)); err != nil { // Send information request count (uint16)
+	if err != nil {
 		return err
 	}
 
-	size := uint64(0)
-	chosenBlockSize := uint32(1)
-
-n:
-	for {
-		var replyHeader protocol.NegotiationReplyHeader
-		if err := binary.Read(conn, binary.BigEndian, &replyHeader); err != nil {
+	var cfd uintptr
+	switch c := transmissionConn.(type) {
+	case *net.TCPConn:
+		file, err := c.File()
+		if err != nil {
 			return err
 		}
 
-		if replyHeader.ReplyMagic != protocol.NEGOTIATION_MAGIC_REPLY {
-			return server.ErrInvalidMagic
+		cfd = uintptr(file.Fd())
+	case *net.UnixConn:
+		file, err := c.File()
+		if err != nil {
+			return err
 		}
 
-		switch replyHeader.Type {
-		case protocol.NEGOTIATION_TYPE_REPLY_INFO:
-			infoRaw := make([]byte, replyHeader.Length)
-			if _, err := io.ReadFull(conn, infoRaw); err != nil {
-				return err
-			}
-
-			var infoType uint16
-			if err := binary.Read(bytes.NewBuffer(infoRaw), binary.BigEndian, &infoType); err != nil {
-				return err
-			}
-
-			switch infoType {
-			case protocol.NEGOTIATION_TYPE_INFO_EXPORT:
-				var info protocol.NegotiationReplyInfo
-				if err := binary.Read(bytes.NewBuffer(infoRaw), binary.BigEndian, &info); err != nil {
-					return err
-				}
-
-				size = info.Size
-			case protocol.NEGOTIATION_TYPE_INFO_NAME:
-				// Discard export name
-			case protocol.NEGOTIATION_TYPE_INFO_DESCRIPTION:
-				// Discard export description
-			case protocol.NEGOTIATION_TYPE_INFO_BLOCKSIZE:
-				var info protocol.NegotiationReplyBlockSize
-				if err := binary.Read(bytes.NewBuffer(infoRaw), binary.BigEndian, &info); err != nil {
-					return err
-				}
-
-				if options.BlockSize == 0 {
-					chosenBlockSize = info.PreferredBlockSize
-				} else if options.BlockSize >= info.MinimumBlockSize && options.BlockSize <= info.MaximumBlockSize {
-					chosenBlockSize = options.BlockSize
-				} else {
-					return ErrUnsupportedServerBlockSize
-				}
+		cfd = uintptr(file.Fd())
+	case *tls.Conn:
+		file, err := proxyTLS(c) // The kernel can't speak TLS, so we hand it a socket that we proxy through the TLS connection
+		if err != nil {
+			return err
+		}
+		defer file.Close()
 
-				if chosenBlockSize > MaximumBlockSize {
-					return ErrMaximumBlockSize
-				} else if chosenBlockSize < MinimumBlockSize {
-					return ErrMinimumBlockSize
-				}
+		cfd = uintptr(file.Fd())
+	default:
+		return ErrUnsupportedNetwork
+	}
 
-				if !((chosenBlockSize > 0) && ((chosenBlockSize & (chosenBlockSize - 1)) == 0)) {
-					return ErrBlockSizeNotPowerOfTwo
-				}
-			default:
-				return ErrUnknownInfo
-			}
-		case protocol.NEGOTIATION_TYPE_REPLY_ACK:
-			break n
-		case protocol.NEGOTIATION_TYPE_REPLY_ERR_UNKNOWN:
-			return ErrUnknownErr
-		default:
-			return ErrUnknownReply
-		}
+	if _, _, err := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		device.Fd(),
+		ioctl.NEGOTIATION_IOCTL_SET_SOCK,
+		uintptr(cfd),
+	); err != 0 {
+		return err
 	}
 
 	if _, _, err := syscall.Syscall(
@@ -331,7 +460,54 @@ n:
 		}
 	}()
 
-	return <-fatal
+	select {
+	case err := <-fatal:
+		return err
+	case <-ctx.Done():
+		if err := Disconnect(device); err != nil {
+			return err
+		}
+
+		<-fatal // Wait until the kernel has stopped using the connection
+
+		_ = conn.Close()
+
+		return ctx.Err()
+	}
+}
+
+func proxyTLS(conn *tls.Conn) (*os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		kernelFile = os.NewFile(uintptr(fds[0]), "nbd-kernel")
+		proxyFile  = os.NewFile(uintptr(fds[1]), "nbd-proxy")
+	)
+	defer proxyFile.Close()
+
+	proxyConn, err := net.FileConn(proxyFile)
+	if err != nil {
+		_ = kernelFile.Close()
+
+		return nil, err
+	}
+
+	go func() {
+		_, _ = io.Copy(conn, proxyConn)
+
+		_ = proxyConn.Close()
+	}()
+
+	go func() {
+		_, _ = io.Copy(proxyConn, conn)
+
+		_ = proxyConn.Close()
+	}()
+
+	return kernelFile, nil
 }
 
 func Disconnect(device *os.File) error {
@@ -366,7 +542,42 @@ func Disconnect(device *os.File) error {
 }
 
 func List(conn net.Conn) ([]string, error) {
-	if err := negotiateNewstyle(conn); err != nil {
+	return ListContext(context.Background(), conn, nil)
+}
+
+func ListContext(ctx context.Context, conn net.Conn, options *Options) ([]string, error) {
+	if options == nil {
+		options = &Options{}
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now()) // Abort the negotiation
+		case <-stop:
+		}
+	}()
+
+	exportNames, err := list(conn, options)
+	if err != nil {
+		if ctx.Err() != nil {
+			_ = conn.Close()
+
+			return []string{}, ctx.Err()
+		}
+
+		return []string{}, err
+	}
+
+	return exportNames, nil
+}
+
+func list(conn net.Conn, options *Options) ([]string, error) {
+	conn, err := negotiateNewstyle(conn, options.TLSConfig)
+	if err != nil {
 		return []string{}, err
 	}
 
@@ -387,6 +598,10 @@ func List(conn net.Conn) ([]string, error) {
 		return []string{}, server.ErrInvalidMagic
 	}
 
+	if replyHeader.Type == protocol.NEGOTIATION_TYPE_REPLY_ERR_TLS_REQD {
+		return []string{}, ErrTLSRequired
+	}
+
 	infoRaw := make([]byte, replyHeader.Length)
 	if _, err := io.ReadFull(conn, infoRaw); err != nil {
 		return []string{}, err
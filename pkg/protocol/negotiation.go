@@ -6,27 +6,59 @@ const (
 	NEGOTIATION_MAGIC_OLDSTYLE = uint64(0x4e42444d41474943)
 	NEGOTIATION_MAGIC_OPTION   = uint64(0x49484156454F5054)
 	NEGOTIATION_MAGIC_REPLY    = uint64(0x3e889045565a9)
+	NEGOTIATION_MAGIC_CLISERV  = uint64(0x00420281861253)
 
 	NEGOTIATION_HANDSHAKE_FLAG_FIXED_NEWSTYLE = uint16(1 << 0)
+	NEGOTIATION_HANDSHAKE_FLAG_NO_ZEROES      = uint16(1 << 1)
 
-	NEGOTIATION_ID_OPTION_ABORT = uint32(2)
-	NEGOTIATION_ID_OPTION_LIST  = uint32(3)
-	NEGOTIATION_ID_OPTION_INFO  = uint32(6)
-	NEGOTIATION_ID_OPTION_GO    = uint32(7)
+	NEGOTIATION_CLIENT_FLAG_FIXED_NEWSTYLE = uint32(1 << 0)
+	NEGOTIATION_CLIENT_FLAG_NO_ZEROES      = uint32(1 << 1)
 
-	NEGOTIATION_TYPE_REPLY_ACK             = uint32(1)
-	NEGOTIATION_TYPE_REPLY_SERVER          = uint32(2)
-	NEGOTIATION_TYPE_REPLY_INFO            = uint32(3)
-	NEGOTIATION_TYPE_REPLY_ERR_UNSUPPORTED = uint32(1 | uint32(1<<31))
-	NEGOTIATION_TYPE_REPLY_ERR_UNKNOWN     = uint32(6 | uint32(1<<31))
+	NEGOTIATION_ID_OPTION_EXPORT_NAME = uint32(1)
+	NEGOTIATION_ID_OPTION_ABORT       = uint32(2)
+	NEGOTIATION_ID_OPTION_LIST        = uint32(3)
+	NEGOTIATION_ID_OPTION_STARTTLS    = uint32(5)
+	NEGOTIATION_ID_OPTION_INFO        = uint32(6)
+	NEGOTIATION_ID_OPTION_GO          = uint32(7)
+
+	NEGOTIATION_ID_OPTION_STRUCTURED_REPLY  = uint32(8)
+	NEGOTIATION_ID_OPTION_LIST_META_CONTEXT = uint32(9)
+	NEGOTIATION_ID_OPTION_SET_META_CONTEXT  = uint32(10)
+	NEGOTIATION_ID_OPTION_EXTENDED_HEADERS  = uint32(11)
+
+	NEGOTIATION_TYPE_REPLY_ACK                 = uint32(1)
+	NEGOTIATION_TYPE_REPLY_SERVER              = uint32(2)
+	NEGOTIATION_TYPE_REPLY_INFO                = uint32(3)
+	NEGOTIATION_TYPE_REPLY_META_CONTEXT        = uint32(4)
+	NEGOTIATION_TYPE_REPLY_ERR_UNSUPPORTED     = uint32(1 | uint32(1<<31))
+	NEGOTIATION_TYPE_REPLY_ERR_POLICY          = uint32(2 | uint32(1<<31))
+	NEGOTIATION_TYPE_REPLY_ERR_INVALID         = uint32(3 | uint32(1<<31))
+	NEGOTIATION_TYPE_REPLY_ERR_TLS_REQD        = uint32(5 | uint32(1<<31))
+	NEGOTIATION_TYPE_REPLY_ERR_UNKNOWN         = uint32(6 | uint32(1<<31))
+	NEGOTIATION_TYPE_REPLY_ERR_SHUTDOWN        = uint32(7 | uint32(1<<31))
+	NEGOTIATION_TYPE_REPLY_ERR_BLOCK_SIZE_REQD = uint32(8 | uint32(1<<31))
+	NEGOTIATION_TYPE_REPLY_ERR_TOO_BIG         = uint32(9 | uint32(1<<31))
+	NEGOTIATION_TYPE_REPLY_ERR_EXT_HEADER_REQD = uint32(11 | uint32(1<<31))
 
 	NEGOTIATION_TYPE_INFO_EXPORT      = uint16(0)
 	NEGOTIATION_TYPE_INFO_NAME        = uint16(1)
 	NEGOTIATION_TYPE_INFO_DESCRIPTION = uint16(2)
 	NEGOTIATION_TYPE_INFO_BLOCKSIZE   = uint16(3)
 
-	NEGOTIATION_REPLY_FLAGS_HAS_FLAGS      = uint16((1 << 0))
-	NEGOTIATION_REPLY_FLAGS_CAN_MULTI_CONN = uint16((1 << 8))
+	NEGOTIATION_REPLY_FLAGS_HAS_FLAGS         = uint16((1 << 0))
+	NEGOTIATION_REPLY_FLAGS_READ_ONLY         = uint16((1 << 1))
+	NEGOTIATION_REPLY_FLAGS_SEND_FLUSH        = uint16((1 << 2))
+	NEGOTIATION_REPLY_FLAGS_SEND_FUA          = uint16((1 << 3))
+	NEGOTIATION_REPLY_FLAGS_ROTATIONAL        = uint16((1 << 4))
+	NEGOTIATION_REPLY_FLAGS_SEND_TRIM         = uint16((1 << 5))
+	NEGOTIATION_REPLY_FLAGS_SEND_WRITE_ZEROES = uint16((1 << 6))
+	NEGOTIATION_REPLY_FLAGS_SEND_DF           = uint16((1 << 7))
+	NEGOTIATION_REPLY_FLAGS_CAN_MULTI_CONN    = uint16((1 << 8))
+	NEGOTIATION_REPLY_FLAGS_SEND_RESIZE       = uint16((1 << 9))
+	NEGOTIATION_REPLY_FLAGS_SEND_CACHE        = uint16((1 << 10))
+	NEGOTIATION_REPLY_FLAGS_SEND_FAST_ZERO    = uint16((1 << 11))
+
+	NEGOTIATION_META_CONTEXT_BASE_ALLOCATION = "base:allocation"
 )
 
 type NegotiationNewstyleHeader struct {
@@ -35,6 +67,14 @@ type NegotiationNewstyleHeader struct {
 	HandshakeFlags uint16
 }
 
+type NegotiationOldstyleHeader struct {
+	OldstyleMagic     uint64
+	CliservMagic      uint64
+	Size              uint64
+	TransmissionFlags uint32
+	Reserved          [124]byte
+}
+
 type NegotiationOptionHeader struct {
 	OptionMagic uint64
 	ID          uint32
@@ -54,6 +94,11 @@ type NegotiationReplyInfo struct {
 	TransmissionFlags uint16
 }
 
+type NegotiationReplyExportName struct {
+	Size              uint64
+	TransmissionFlags uint16
+}
+
 type NegotiationReplyNameHeader struct {
 	Type uint16
 }
@@ -66,3 +111,7 @@ type NegotiationReplyBlockSize struct {
 	PreferredBlockSize uint32
 	MaximumBlockSize   uint32
 }
+
+type NegotiationReplyMetaContextHeader struct {
+	ID uint32
+}
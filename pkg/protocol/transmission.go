@@ -1,15 +1,50 @@
 package protocol
 
 const (
-	TRANSMISSION_MAGIC_REQUEST = uint32(0x25609513)
-	TRANSMISSION_MAGIC_REPLY   = uint32(0x67446698)
+	TRANSMISSION_MAGIC_REQUEST          = uint32(0x25609513)
+	TRANSMISSION_MAGIC_REPLY            = uint32(0x67446698)
+	TRANSMISSION_MAGIC_STRUCTURED_REPLY = uint32(0x668e33ef)
+	TRANSMISSION_MAGIC_EXTENDED_REQUEST = uint32(0x21e41c71)
+	TRANSMISSION_MAGIC_EXTENDED_REPLY   = uint32(0x6e8a278c)
 
-	TRANSMISSION_TYPE_REQUEST_READ  = uint16(0)
-	TRANSMISSION_TYPE_REQUEST_WRITE = uint16(1)
-	TRANSMISSION_TYPE_REQUEST_DISC  = uint16(2)
+	TRANSMISSION_TYPE_REQUEST_READ         = uint16(0)
+	TRANSMISSION_TYPE_REQUEST_WRITE        = uint16(1)
+	TRANSMISSION_TYPE_REQUEST_DISC         = uint16(2)
+	TRANSMISSION_TYPE_REQUEST_FLUSH        = uint16(3)
+	TRANSMISSION_TYPE_REQUEST_TRIM         = uint16(4)
+	TRANSMISSION_TYPE_REQUEST_WRITE_ZEROES = uint16(6)
+	TRANSMISSION_TYPE_REQUEST_CACHE        = uint16(5)
+	TRANSMISSION_TYPE_REQUEST_BLOCK_STATUS = uint16(7)
+	TRANSMISSION_TYPE_REQUEST_RESIZE       = uint16(8) // See https://github.com/NetworkBlockDevice/nbd/blob/extension-resize/doc/proto.md
 
-	TRANSMISSION_ERROR_EPERM  = uint32(1)
-	TRANSMISSION_ERROR_EINVAL = uint32(22)
+	TRANSMISSION_FLAG_COMMAND_FUA         = uint16(1 << 0)
+	TRANSMISSION_FLAG_COMMAND_NO_HOLE     = uint16(1 << 1)
+	TRANSMISSION_FLAG_COMMAND_DF          = uint16(1 << 2)
+	TRANSMISSION_FLAG_COMMAND_REQ_ONE     = uint16(1 << 3)
+	TRANSMISSION_FLAG_COMMAND_FAST_ZERO   = uint16(1 << 4)
+	TRANSMISSION_FLAG_COMMAND_PAYLOAD_LEN = uint16(1 << 5)
+
+	TRANSMISSION_TYPE_REPLY_NONE             = uint16(0)
+	TRANSMISSION_TYPE_REPLY_OFFSET_DATA      = uint16(1)
+	TRANSMISSION_TYPE_REPLY_OFFSET_HOLE      = uint16(2)
+	TRANSMISSION_TYPE_REPLY_BLOCK_STATUS     = uint16(5)
+	TRANSMISSION_TYPE_REPLY_BLOCK_STATUS_EXT = uint16(6)
+	TRANSMISSION_TYPE_REPLY_ERROR            = uint16(1 | uint16(1<<15))
+	TRANSMISSION_TYPE_REPLY_ERROR_OFFSET     = uint16(2 | uint16(1<<15))
+
+	TRANSMISSION_FLAG_REPLY_DONE = uint16(1 << 0)
+
+	TRANSMISSION_STATE_BASE_ALLOCATION_HOLE = uint32(1 << 0)
+	TRANSMISSION_STATE_BASE_ALLOCATION_ZERO = uint32(1 << 1)
+
+	TRANSMISSION_ERROR_EPERM     = uint32(1)
+	TRANSMISSION_ERROR_EIO       = uint32(5)
+	TRANSMISSION_ERROR_ENOMEM    = uint32(12)
+	TRANSMISSION_ERROR_EINVAL    = uint32(22)
+	TRANSMISSION_ERROR_ENOSPC    = uint32(28)
+	TRANSMISSION_ERROR_EOVERFLOW = uint32(75)
+	TRANSMISSION_ERROR_ENOTSUP   = uint32(95)
+	TRANSMISSION_ERROR_ESHUTDOWN = uint32(108)
 )
 
 type TransmissionRequestHeader struct {
@@ -21,8 +56,63 @@ type TransmissionRequestHeader struct {
 	Length       uint32
 }
 
+type TransmissionExtendedRequestHeader struct {
+	RequestMagic uint32
+	CommandFlags uint16
+	Type         uint16
+	Handle       uint64
+	Offset       uint64
+	Length       uint64
+}
+
 type TransmissionReplyHeader struct {
 	ReplyMagic uint32
 	Error      uint32
 	Handle     uint64
 }
+
+type TransmissionStructuredReplyHeader struct {
+	ReplyMagic uint32
+	Flags      uint16
+	Type       uint16
+	Handle     uint64
+	Length     uint32
+}
+
+type TransmissionExtendedReplyHeader struct {
+	ReplyMagic uint32
+	Flags      uint16
+	Type       uint16
+	Handle     uint64
+	Offset     uint64
+	Length     uint64
+}
+
+type TransmissionStructuredReplyOffsetHole struct {
+	Offset uint64
+	Length uint32
+}
+
+type TransmissionStructuredReplyErrorHeader struct {
+	Error         uint32
+	MessageLength uint16
+}
+
+type TransmissionStructuredReplyBlockStatusHeader struct {
+	ContextID uint32
+}
+
+type TransmissionStructuredReplyBlockStatusDescriptor struct {
+	Length uint32
+	Status uint32
+}
+
+type TransmissionStructuredReplyBlockStatusExtHeader struct {
+	ContextID       uint32
+	DescriptorCount uint32
+}
+
+type TransmissionStructuredReplyBlockStatusExtDescriptor struct {
+	Length uint64
+	Status uint64
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCredentials(conn *net.UnixConn) *Credentials {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var (
+		ucred *syscall.Ucred
+		uerr  error
+	)
+	if err := rawConn.Control(func(fd uintptr) {
+		ucred, uerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || uerr != nil {
+		return nil
+	}
+
+	return &Credentials{
+		PID: ucred.Pid,
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import "context"
+
+// Request is a transmission request as it is passed through the interceptors
+type Request struct {
+	Export *Export // Changing the export or the handle has no effect
+	Handle uint64
+
+	Type   uint16
+	Flags  uint16
+	Offset uint64
+	Length uint64
+	Data   []byte // Payload of writes, which also determines their length
+}
+
+// RequestError is returned by `next` if the request failed and an error reply was prepared for it
+type RequestError struct {
+	Errno uint32 // NBD error that is sent to the client
+	Err   error  // Error of the backend, if any
+}
+
+func (e *RequestError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+
+	return "request failed with " + errorName(e.Errno)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Handler executes a request; errors are sent to the client as the closest matching NBD error
+type Handler func(ctx context.Context, req *Request) error
+
+// Interceptor is called for every request and can observe, modify, delay or fail it; call `next` to execute it.
+// Requests that were never passed to `next` succeed without being executed if the interceptor returns `nil`,
+// except for reads and block status queries, which fail with `NBD_EIO`
+type Interceptor func(ctx context.Context, req *Request, next Handler) error
+
+func chain(interceptors []Interceptor, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+
+		handler = func(ctx context.Context, req *Request) error {
+			return interceptor(ctx, req, next)
+		}
+	}
+
+	return handler
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pojntfx/go-nbd/pkg/backend"
+	"github.com/pojntfx/go-nbd/pkg/protocol"
+)
+
+type failingBackend struct {
+	*backend.MemoryBackend
+}
+
+func (b *failingBackend) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.ENOSPC
+}
+
+func connect(t *testing.T, b backend.Backend, interceptors ...Interceptor) net.Conn {
+	t.Helper()
+
+	return connectWithOptions(t, b, &Options{Interceptors: interceptors})
+}
+
+func connectWithOptions(t *testing.T, b backend.Backend, options *Options) net.Conn {
+	t.Helper()
+
+	client, conn := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	go func() {
+		_ = Handle(conn, []*Export{{Name: "default", Backend: b}}, options)
+		_ = conn.Close()
+	}()
+
+	if err := client.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	var header protocol.NegotiationNewstyleHeader
+	if err := binary.Read(client, binary.BigEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := binary.Write(client, binary.BigEndian, protocol.NEGOTIATION_CLIENT_FLAG_FIXED_NEWSTYLE|protocol.NEGOTIATION_CLIENT_FLAG_NO_ZEROES); err != nil {
+		t.Fatal(err)
+	}
+
+	exportName := []byte("default")
+	if err := binary.Write(client, binary.BigEndian, protocol.NegotiationOptionHeader{
+		OptionMagic: protocol.NEGOTIATION_MAGIC_OPTION,
+		ID:          protocol.NEGOTIATION_ID_OPTION_EXPORT_NAME,
+		Length:      uint32(len(exportName)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Write(exportName); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply protocol.NegotiationReplyExportName
+	if err := binary.Read(client, binary.BigEndian, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func sendRequest(t *testing.T, client net.Conn, requestType uint16, handle uint64, data []byte) protocol.TransmissionReplyHeader {
+	t.Helper()
+
+	return sendRequestAt(t, client, requestType, handle, 0, data)
+}
+
+func sendRequestAt(t *testing.T, client net.Conn, requestType uint16, handle uint64, offset uint64, data []byte) protocol.TransmissionReplyHeader {
+	t.Helper()
+
+	if err := binary.Write(client, binary.BigEndian, protocol.TransmissionRequestHeader{
+		RequestMagic: protocol.TRANSMISSION_MAGIC_REQUEST,
+		Type:         requestType,
+		Handle:       handle,
+		Offset:       offset,
+		Length:       uint32(len(data)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply protocol.TransmissionReplyHeader
+	if err := binary.Read(client, binary.BigEndian, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Handle != handle {
+		t.Fatalf("got reply for handle %v, expected %v", reply.Handle, handle)
+	}
+
+	return reply
+}
+
+func TestInterceptorWithoutNext(t *testing.T) {
+	client := connect(t, backend.NewMemoryBackend(make([]byte, 4096)), func(ctx context.Context, req *Request, next Handler) error {
+		return nil
+	})
+
+	if reply := sendRequest(t, client, protocol.TRANSMISSION_TYPE_REQUEST_WRITE, 1, make([]byte, 512)); reply.Error != 0 {
+		t.Fatalf("got error %v, expected success", reply.Error)
+	}
+
+	if reply := sendRequest(t, client, protocol.TRANSMISSION_TYPE_REQUEST_FLUSH, 2, nil); reply.Error != 0 {
+		t.Fatalf("got error %v, expected success", reply.Error)
+	}
+}
+
+func TestInterceptorCallingNextTwice(t *testing.T) {
+	client := connect(t, backend.NewMemoryBackend(make([]byte, 4096)), func(ctx context.Context, req *Request, next Handler) error {
+		if err := next(ctx, req); err != nil {
+			return err
+		}
+
+		return next(ctx, req)
+	})
+
+	if reply := sendRequest(t, client, protocol.TRANSMISSION_TYPE_REQUEST_WRITE, 1, make([]byte, 512)); reply.Error != 0 {
+		t.Fatalf("got error %v, expected success", reply.Error)
+	}
+
+	if reply := sendRequest(t, client, protocol.TRANSMISSION_TYPE_REQUEST_FLUSH, 2, nil); reply.Error != 0 { // A second reply for the write would be read here instead
+		t.Fatalf("got error %v, expected success", reply.Error)
+	}
+}
+
+func TestInterceptorObservesBackendErrors(t *testing.T) {
+	var observed error
+	client := connect(t, &failingBackend{backend.NewMemoryBackend(make([]byte, 4096))}, func(ctx context.Context, req *Request, next Handler) error {
+		observed = next(ctx, req)
+
+		return observed
+	})
+
+	if reply := sendRequest(t, client, protocol.TRANSMISSION_TYPE_REQUEST_WRITE, 1, make([]byte, 512)); reply.Error != protocol.TRANSMISSION_ERROR_ENOSPC {
+		t.Fatalf("got error %v, expected %v", reply.Error, protocol.TRANSMISSION_ERROR_ENOSPC)
+	}
+
+	var requestErr *RequestError
+	if !errors.As(observed, &requestErr) || requestErr.Errno != protocol.TRANSMISSION_ERROR_ENOSPC || !errors.Is(observed, syscall.ENOSPC) {
+		t.Fatalf("got %v, expected the backend's error", observed)
+	}
+
+	if reply := sendRequest(t, client, protocol.TRANSMISSION_TYPE_REQUEST_FLUSH, 2, nil); reply.Error != 0 {
+		t.Fatalf("got error %v, expected success", reply.Error)
+	}
+}
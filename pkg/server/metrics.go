@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/go-nbd/pkg/protocol"
+)
+
+var (
+	durationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10} // In seconds
+
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// Collector receives metrics about the connections of a server and the requests they send
+type Collector interface {
+	ConnectionOpened(conn net.Conn, export *Export)
+	ConnectionClosed(conn net.Conn, export *Export)
+	RequestCompleted(conn net.Conn, export *Export, command uint16, length uint64, errorType uint32, duration time.Duration) // `errorType` is 0 if the request succeeded
+}
+
+type commandMetrics struct {
+	requests uint64
+	bytes    uint64
+	errors   map[uint32]uint64
+	buckets  []uint64 // Number of requests per bucket; the last bucket is +Inf
+	duration float64
+}
+
+type exportMetrics struct {
+	connections       uint64
+	activeConnections uint64
+	commands          map[string]*commandMetrics // By command name, so that all unknown commands share their metrics
+}
+
+type connectionMetrics struct {
+	id         uint64
+	export     string
+	remoteAddr string
+
+	requests uint64
+	bytes    uint64
+	errors   uint64
+}
+
+// PrometheusCollector keeps metrics in memory and exposes them in the Prometheus text format
+type PrometheusCollector struct {
+	lock             sync.Mutex
+	exports          map[string]*exportMetrics
+	connections      map[net.Conn]*connectionMetrics
+	nextConnectionID uint64
+}
+
+func NewPrometheusCollector() *PrometheusCollector {
+	return &PrometheusCollector{
+		exports:     map[string]*exportMetrics{},
+		connections: map[net.Conn]*connectionMetrics{},
+	}
+}
+
+func (c *PrometheusCollector) exportMetrics(name string) *exportMetrics {
+	m, ok := c.exports[name]
+	if !ok {
+		m = &exportMetrics{
+			commands: map[string]*commandMetrics{},
+		}
+
+		c.exports[name] = m
+	}
+
+	return m
+}
+
+func (c *PrometheusCollector) ConnectionOpened(conn net.Conn, export *Export) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	m := c.exportMetrics(export.Name)
+	m.connections++
+	m.activeConnections++
+
+	c.nextConnectionID++
+	c.connections[conn] = &connectionMetrics{
+		id:         c.nextConnectionID,
+		export:     export.Name,
+		remoteAddr: conn.RemoteAddr().String(),
+	}
+}
+
+func (c *PrometheusCollector) ConnectionClosed(conn net.Conn, export *Export) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.exportMetrics(export.Name).activeConnections--
+
+	delete(c.connections, conn)
+}
+
+// Forget drops the metrics of an export that no client is using anymore; call it from `RegistryHooks.OnRelease`
+// so that the metrics of exports that are resolved on demand don't accumulate
+func (c *PrometheusCollector) Forget(export *Export) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if m, ok := c.exports[export.Name]; ok && m.activeConnections == 0 {
+		delete(c.exports, export.Name)
+	}
+}
+
+func (c *PrometheusCollector) RequestCompleted(conn net.Conn, export *Export, command uint16, length uint64, errorType uint32, duration time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	commands := c.exportMetrics(export.Name).commands
+
+	name := commandName(command)
+
+	m, ok := commands[name]
+	if !ok {
+		m = &commandMetrics{
+			errors:  map[uint32]uint64{},
+			buckets: make([]uint64, len(durationBuckets)+1),
+		}
+
+		commands[name] = m
+	}
+
+	connection, ok := c.connections[conn]
+	if !ok {
+		connection = &connectionMetrics{} // The connection was closed concurrently, so we only count the request for the export
+	}
+
+	m.requests++
+	connection.requests++
+
+	if errorType == 0 {
+		m.bytes += length
+		connection.bytes += length
+	} else {
+		m.errors[errorType]++
+		connection.errors++
+	}
+
+	seconds := duration.Seconds()
+	bucket := sort.SearchFloat64s(durationBuckets, seconds) // Buckets include their upper bound
+	m.buckets[bucket]++
+	m.duration += seconds
+}
+
+func (c *PrometheusCollector) WriteTo(w io.Writer) (int64, error) {
+	c.lock.Lock()
+
+	buf := &bytes.Buffer{}
+
+	exportNames := []string{}
+	for name := range c.exports {
+		exportNames = append(exportNames, name)
+	}
+	sort.Strings(exportNames)
+
+	writeHeader(buf, "nbd_connections_total", "counter", "Number of connections that selected an export.")
+	for _, name := range exportNames {
+		writeSample(buf, "nbd_connections_total", labels("export", name), float64(c.exports[name].connections))
+	}
+
+	writeHeader(buf, "nbd_connections_active", "gauge", "Number of connections that are currently using an export.")
+	for _, name := range exportNames {
+		writeSample(buf, "nbd_connections_active", labels("export", name), float64(c.exports[name].activeConnections))
+	}
+
+	writeHeader(buf, "nbd_requests_total", "counter", "Number of requests by command.")
+	c.eachCommand(exportNames, func(commandLabels []string, m *commandMetrics) {
+		writeSample(buf, "nbd_requests_total", labels(commandLabels...), float64(m.requests))
+	})
+
+	writeHeader(buf, "nbd_request_bytes_total", "counter", "Number of bytes that successful requests covered by command.")
+	c.eachCommand(exportNames, func(commandLabels []string, m *commandMetrics) {
+		writeSample(buf, "nbd_request_bytes_total", labels(commandLabels...), float64(m.bytes))
+	})
+
+	writeHeader(buf, "nbd_request_errors_total", "counter", "Number of requests that failed by command and error.")
+	c.eachCommand(exportNames, func(commandLabels []string, m *commandMetrics) {
+		errorTypes := []uint32{}
+		for errorType := range m.errors {
+			errorTypes = append(errorTypes, errorType)
+		}
+		sort.Slice(errorTypes, func(i, j int) bool { return errorTypes[i] < errorTypes[j] })
+
+		for _, errorType := range errorTypes {
+			writeSample(buf, "nbd_request_errors_total", labels(append(commandLabels, "error", errorName(errorType))...), float64(m.errors[errorType]))
+		}
+	})
+
+	writeHeader(buf, "nbd_request_duration_seconds", "histogram", "Time from receiving a request until its reply was ready by command.")
+	c.eachCommand(exportNames, func(commandLabels []string, m *commandMetrics) {
+		count := uint64(0)
+		for i, upperBound := range durationBuckets {
+			count += m.buckets[i]
+
+			writeSample(buf, "nbd_request_duration_seconds_bucket", labels(append(commandLabels, "le", strconv.FormatFloat(upperBound, 'g', -1, 64))...), float64(count))
+		}
+
+		count += m.buckets[len(durationBuckets)]
+
+		writeSample(buf, "nbd_request_duration_seconds_bucket", labels(append(commandLabels, "le", "+Inf")...), float64(count))
+		writeSample(buf, "nbd_request_duration_seconds_sum", labels(commandLabels...), m.duration)
+		writeSample(buf, "nbd_request_duration_seconds_count", labels(commandLabels...), float64(count))
+	})
+
+	connections := []*connectionMetrics{}
+	for _, m := range c.connections {
+		connections = append(connections, m)
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].id < connections[j].id })
+
+	writeHeader(buf, "nbd_connection_requests_total", "counter", "Number of requests by connection.")
+	for _, m := range connections {
+		writeSample(buf, "nbd_connection_requests_total", m.labels(), float64(m.requests))
+	}
+
+	writeHeader(buf, "nbd_connection_bytes_total", "counter", "Number of bytes that successful requests covered by connection.")
+	for _, m := range connections {
+		writeSample(buf, "nbd_connection_bytes_total", m.labels(), float64(m.bytes))
+	}
+
+	writeHeader(buf, "nbd_connection_errors_total", "counter", "Number of requests that failed by connection.")
+	for _, m := range connections {
+		writeSample(buf, "nbd_connection_errors_total", m.labels(), float64(m.errors))
+	}
+
+	c.lock.Unlock()
+
+	return buf.WriteTo(w)
+}
+
+func (c *PrometheusCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	_, _ = c.WriteTo(w)
+}
+
+func (c *PrometheusCollector) eachCommand(exportNames []string, fn func(commandLabels []string, m *commandMetrics)) {
+	for _, name := range exportNames {
+		commands := []string{}
+		for command := range c.exports[name].commands {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+
+		for _, command := range commands {
+			fn([]string{"export", name, "command", command}, c.exports[name].commands[command])
+		}
+	}
+}
+
+func (m *connectionMetrics) labels() string {
+	return labels("export", m.export, "connection", strconv.FormatUint(m.id, 10), "remote_addr", m.remoteAddr)
+}
+
+func labels(pairs ...string) string {
+	formatted := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		formatted = append(formatted, pairs[i]+`="`+labelValueReplacer.Replace(pairs[i+1])+`"`)
+	}
+
+	return "{" + strings.Join(formatted, ",") + "}"
+}
+
+func writeHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, metricType)
+}
+
+func writeSample(w io.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%v%v %v\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func commandName(command uint16) string {
+	switch command {
+	case protocol.TRANSMISSION_TYPE_REQUEST_READ:
+		return "read"
+	case protocol.TRANSMISSION_TYPE_REQUEST_WRITE:
+		return "write"
+	case protocol.TRANSMISSION_TYPE_REQUEST_FLUSH:
+		return "flush"
+	case protocol.TRANSMISSION_TYPE_REQUEST_TRIM:
+		return "trim"
+	case protocol.TRANSMISSION_TYPE_REQUEST_CACHE:
+		return "cache"
+	case protocol.TRANSMISSION_TYPE_REQUEST_WRITE_ZEROES:
+		return "write_zeroes"
+	case protocol.TRANSMISSION_TYPE_REQUEST_BLOCK_STATUS:
+		return "block_status"
+	case protocol.TRANSMISSION_TYPE_REQUEST_RESIZE:
+		return "resize"
+	default:
+		return "unknown"
+	}
+}
+
+func errorName(errorType uint32) string {
+	switch errorType {
+	case protocol.TRANSMISSION_ERROR_EPERM:
+		return "EPERM"
+	case protocol.TRANSMISSION_ERROR_EIO:
+		return "EIO"
+	case protocol.TRANSMISSION_ERROR_ENOMEM:
+		return "ENOMEM"
+	case protocol.TRANSMISSION_ERROR_EINVAL:
+		return "EINVAL"
+	case protocol.TRANSMISSION_ERROR_ENOSPC:
+		return "ENOSPC"
+	case protocol.TRANSMISSION_ERROR_EOVERFLOW:
+		return "EOVERFLOW"
+	case protocol.TRANSMISSION_ERROR_ENOTSUP:
+		return "ENOTSUP"
+	case protocol.TRANSMISSION_ERROR_ESHUTDOWN:
+		return "ESHUTDOWN"
+	default:
+		return strconv.FormatUint(uint64(errorType), 10)
+	}
+}
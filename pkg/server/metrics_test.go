@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pojntfx/go-nbd/pkg/backend"
+	"github.com/pojntfx/go-nbd/pkg/protocol"
+)
+
+func waitForMetric(t *testing.T, collector *PrometheusCollector, sample string) string {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		buf := &bytes.Buffer{}
+		if _, err := collector.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(buf.String(), sample) {
+			return buf.String()
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got metrics\n%v\nexpected them to contain %v", buf.String(), sample)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPrometheusCollectorKeepsMetricsAfterDisconnect(t *testing.T) {
+	collector := NewPrometheusCollector()
+
+	client := connectWithOptions(t, backend.NewMemoryBackend(make([]byte, 4096)), &Options{Collector: collector})
+
+	if reply := sendRequest(t, client, protocol.TRANSMISSION_TYPE_REQUEST_WRITE, 1, make([]byte, 512)); reply.Error != 0 {
+		t.Fatalf("got error %v, expected success", reply.Error)
+	}
+
+	if err := binary.Write(client, binary.BigEndian, protocol.TransmissionRequestHeader{
+		RequestMagic: protocol.TRANSMISSION_MAGIC_REQUEST,
+		Type:         protocol.TRANSMISSION_TYPE_REQUEST_DISC,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := waitForMetric(t, collector, `nbd_connections_active{export="default"} 0`)
+	for _, sample := range []string{
+		`nbd_connections_total{export="default"} 1`,
+		`nbd_requests_total{export="default",command="write"} 1`,
+		`nbd_request_bytes_total{export="default",command="write"} 512`,
+	} {
+		if !strings.Contains(metrics, sample) {
+			t.Fatalf("got metrics\n%v\nexpected them to contain %v", metrics, sample)
+		}
+	}
+
+	collector.Forget(&Export{Name: "default"})
+
+	if metrics := waitForMetric(t, collector, "# TYPE nbd_connections_total counter"); strings.Contains(metrics, `export="default"`) {
+		t.Fatalf("got metrics\n%v\nexpected the export's metrics to be dropped", metrics)
+	}
+}
+
+func TestPrometheusCollectorForgetKeepsActiveExports(t *testing.T) {
+	collector := NewPrometheusCollector()
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	export := &Export{Name: "default"}
+
+	collector.ConnectionOpened(conn, export)
+	collector.Forget(export)
+
+	waitForMetric(t, collector, `nbd_connections_active{export="default"} 1`)
+}
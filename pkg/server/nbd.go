@@ -2,22 +2,49 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"io"
 	"net"
+	"time"
 
 	"github.com/pojntfx/go-nbd/pkg/backend"
 	"github.com/pojntfx/go-nbd/pkg/protocol"
 )
 
 var (
-	ErrInvalidMagic     = errors.New("invalid magic")
-	ErrInvalidBlocksize = errors.New("invalid blocksize")
+	ErrInvalidMagic       = errors.New("invalid magic")
+	ErrInvalidBlocksize   = errors.New("invalid blocksize")
+	ErrInvalidMetaContext = errors.New("invalid meta context option")
+	ErrServerClosed       = errors.New("server closed")
+	ErrTLSConfigMissing   = errors.New("TLS is required but no TLS config was provided")
+	ErrTLSRequired        = errors.New("client tried to select an export without TLS")
+	ErrUnknownExport      = errors.New("unknown export")
+	ErrInvalidClientFlags = errors.New("invalid client flags")
+	ErrNotFixedNewstyle   = errors.New("client doesn't support fixed newstyle negotiation")
+	ErrInvalidInfo        = errors.New("invalid info option")
+	ErrAccessDenied       = errors.New("client isn't authorized to access export")
 )
 
 const (
 	defaultMaximumRequestSize = 32 * 1024 * 1024 // Support for a 32M maximum packet size is expected: https://sourceforge.net/p/nbd/mailman/message/35081223/
+	defaultWorkers            = 8
+	defaultQueueDepth         = 128 // The Linux kernel's NBD client keeps up to 128 requests in flight per connection by default
+	defaultMaximumInFlight    = 4 * defaultMaximumRequestSize
+
+	holeDetectionBlockSize    = 4096        // Granularity at which zeroed regions of a read are sent as holes instead of data
+	zeroWriteBlockSize        = 1024 * 1024 // Maximum size of the buffer used to write zeroes if the backend can't zero regions itself
+	maximumErrorMessageLength = 4096        // Error messages in structured replies must not exceed 4K: https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md#structured-reply-types
+	maximumOptionLength       = 64 * 1024   // Upper bound for option data we buffer in memory, such as meta context queries
+
+	metaContextIDBaseAllocation = uint32(1)
+)
+
+var (
+	zeroBlock = make([]byte, holeDetectionBlockSize)
 )
 
 type Export struct {
@@ -25,6 +52,25 @@ type Export struct {
 	Description string
 
 	Backend backend.Backend
+
+	ReadOnly *bool // Falls back to `Options.ReadOnly` if unset
+
+	MinimumBlockSize   uint32 // Block sizes that are unset fall back to the ones in `Options`
+	PreferredBlockSize uint32
+	MaximumBlockSize   uint32
+
+	SupportsMultiConn *bool // Falls back to `Options.SupportsMultiConn` if unset
+}
+
+// Resize changes the size of the export's backend; requests of connected clients are checked against the new size,
+// and clients that negotiate afterwards are told about it
+func (e *Export) Resize(size int64) error {
+	resizer, ok := e.Backend.(backend.Resizer)
+	if !ok {
+		return backend.ErrUnsupported
+	}
+
+	return resizer.Resize(size)
 }
 
 type Options struct {
@@ -36,9 +82,59 @@ type Options struct {
 
 	MaximumRequestSize int
 	SupportsMultiConn  bool
+
+	Workers    int
+	QueueDepth int
+
+	MaximumInFlight int // Upper bound for the bytes of read and write payloads that a connection buffers at once; a single request may always use up to `MaximumRequestSize`
+
+	TLSConfig   *tls.Config // Set `ClientAuth` and `ClientCAs` to require and verify client certificates
+	TLSRequired bool
+
+	OldstyleExportName    string // If set, clients are served this export using the oldstyle handshake, which doesn't support negotiating any options
+	FixedNewstyleRequired bool
+
+	Authorize func(client *Client, exportName string) Access // If set, called before a client selects or queries an export
+
+	Interceptors []Interceptor // Called in order for every transmission request before it is executed
+
+	Collector Collector // If set, receives metrics about connections and requests
+}
+
+type Access int
+
+const (
+	AccessDenied Access = iota
+	AccessReadOnly
+	AccessReadWrite
+)
+
+type Client struct {
+	RemoteAddr       net.Addr
+	PeerCertificates []*x509.Certificate // Set if the client sent a certificate during the TLS handshake
+	Credentials      *Credentials        // Set for Unix socket connections on platforms that support `SO_PEERCRED`
+}
+
+type Credentials struct {
+	PID int32
+	UID uint32
+	GID uint32
 }
 
 func Handle(conn net.Conn, exports []*Export, options *Options) error {
+	return HandleContext(context.Background(), conn, exports, options)
+}
+
+func HandleContext(ctx context.Context, conn net.Conn, exports []*Export, options *Options) error {
+	return handle(ctx, conn, NewRegistry(exports), options, nil)
+}
+
+// HandleRegistry is like HandleContext, but looks up exports in a registry that can be changed while the client is connected
+func HandleRegistry(ctx context.Context, conn net.Conn, registry *Registry, options *Options) error {
+	return handle(ctx, conn, registry, options, nil)
+}
+
+func handle(ctx context.Context, conn net.Conn, registry *Registry, options *Options, shutdown <-chan struct{}) error {
 	if options == nil {
 		options = &Options{
 			ReadOnly:          false,
@@ -52,6 +148,10 @@ func Handle(conn net.Conn, exports []*Export, options *Options) error {
 
 	if options.PreferredBlockSize == 0 {
 		options.PreferredBlockSize = 4096
+
+		if options.PreferredBlockSize < options.MinimumBlockSize {
+			options.PreferredBlockSize = options.MinimumBlockSize
+		}
 	}
 
 	if options.MaximumBlockSize == 0 {
@@ -62,102 +162,281 @@ func Handle(conn net.Conn, exports []*Export, options *Options) error {
 		options.MaximumRequestSize = defaultMaximumRequestSize
 	}
 
-	// Negotiation
+	if options.Workers == 0 {
+		options.Workers = defaultWorkers
+	}
+
+	if options.QueueDepth == 0 {
+		options.QueueDepth = defaultQueueDepth
+	}
+
+	if options.MaximumInFlight == 0 {
+		options.MaximumInFlight = defaultMaximumInFlight
+	}
+
+	if options.TLSRequired && options.TLSConfig == nil {
+		return ErrTLSConfigMissing
+	}
+
+	if !isPowerOfTwo(options.MinimumBlockSize) ||
+		!isPowerOfTwo(options.PreferredBlockSize) ||
+		options.PreferredBlockSize < options.MinimumBlockSize ||
+		options.MaximumBlockSize < options.PreferredBlockSize {
+		return ErrInvalidBlocksize
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now()) // Unblock pending reads and writes so that the connection can be torn down
+		case <-stop:
+		}
+	}()
+
+	s := &session{cancel: cancel}
+	defer registry.detach(s)
+
+	t, err := negotiate(conn, registry, s, options, shutdown)
+	if err == nil && t != nil {
+		t.ctx = ctx
+		t.shutdown = shutdown
+
+		if collector := t.options.Collector; collector != nil {
+			collector.ConnectionOpened(t.conn, t.export)
+		}
+
+		err = t.serve()
+
+		if collector := t.options.Collector; collector != nil {
+			collector.ConnectionClosed(t.conn, t.export)
+		}
+	}
+
+	if ctx.Err() != nil {
+		_ = conn.Close() // The connection is unusable after we've set its deadline
+
+		return context.Cause(ctx)
+	}
+
+	return err
+}
+
+func negotiate(conn net.Conn, registry *Registry, s *session, options *Options, shutdown <-chan struct{}) (*transmission, error) {
+	if options.OldstyleExportName != "" {
+		return negotiateOldstyle(conn, registry, s, options)
+	}
+
 	if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationNewstyleHeader{
 		OldstyleMagic:  protocol.NEGOTIATION_MAGIC_OLDSTYLE,
 		OptionMagic:    protocol.NEGOTIATION_MAGIC_OPTION,
-		HandshakeFlags: protocol.NEGOTIATION_HANDSHAKE_FLAG_FIXED_NEWSTYLE,
+		HandshakeFlags: protocol.NEGOTIATION_HANDSHAKE_FLAG_FIXED_NEWSTYLE | protocol.NEGOTIATION_HANDSHAKE_FLAG_NO_ZEROES,
 	}); err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err := io.CopyN(io.Discard, conn, 4) // Discard client flags (uint32)
-	if err != nil {
-		return err
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return nil, err
+	}
+
+	if clientFlags&^(protocol.NEGOTIATION_CLIENT_FLAG_FIXED_NEWSTYLE|protocol.NEGOTIATION_CLIENT_FLAG_NO_ZEROES) != 0 {
+		return nil, ErrInvalidClientFlags // Clients must not set flags that we haven't advertised
 	}
 
-	var export *Export
+	if options.FixedNewstyleRequired && clientFlags&protocol.NEGOTIATION_CLIENT_FLAG_FIXED_NEWSTYLE == 0 {
+		return nil, ErrNotFixedNewstyle
+	}
+
+	var (
+		export            *Export
+		exportOptions     *Options
+		size              int64
+		tlsEstablished    bool
+		structuredReplies bool
+		extendedHeaders   bool
+
+		baseAllocation        bool
+		metaContextExportName string
+
+		blockSizeRequested bool
+	)
 n:
 	for {
 		var optionHeader protocol.NegotiationOptionHeader
 		if err := binary.Read(conn, binary.BigEndian, &optionHeader); err != nil {
-			return err
+			return nil, err
 		}
 
 		if optionHeader.OptionMagic != protocol.NEGOTIATION_MAGIC_OPTION {
-			return ErrInvalidMagic
+			return nil, ErrInvalidMagic
 		}
 
-		switch optionHeader.ID {
-		case protocol.NEGOTIATION_ID_OPTION_INFO, protocol.NEGOTIATION_ID_OPTION_GO:
-			var exportNameLength uint32
-			if err := binary.Read(conn, binary.BigEndian, &exportNameLength); err != nil {
-				return err
+		select {
+		case <-shutdown:
+			if optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_EXPORT_NAME {
+				return nil, ErrServerClosed // Clients don't expect a reply to `NBD_OPT_EXPORT_NAME` if it fails
 			}
 
-			exportName := make([]byte, exportNameLength)
-			if _, err := io.ReadFull(conn, exportName); err != nil {
-				return err
+			_, err := io.CopyN(io.Discard, conn, int64(optionHeader.Length)) // Discard the option's data
+			if err != nil {
+				return nil, err
+			}
+
+			if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+				ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+				ID:         optionHeader.ID,
+				Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_SHUTDOWN,
+				Length:     0,
+			}); err != nil {
+				return nil, err
 			}
 
-			for _, candidate := range exports {
-				if candidate.Name == string(exportName) {
-					export = candidate
+			return nil, ErrServerClosed
+		default:
+		}
 
-					break
+		if options.TLSRequired && !tlsEstablished &&
+			optionHeader.ID != protocol.NEGOTIATION_ID_OPTION_STARTTLS &&
+			optionHeader.ID != protocol.NEGOTIATION_ID_OPTION_ABORT {
+			if optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_EXPORT_NAME {
+				return nil, ErrTLSRequired
+			}
+
+			_, err := io.CopyN(io.Discard, conn, int64(optionHeader.Length)) // Discard the option's data
+			if err != nil {
+				return nil, err
+			}
+
+			if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+				ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+				ID:         optionHeader.ID,
+				Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_TLS_REQD,
+				Length:     0,
+			}); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		switch optionHeader.ID {
+		case protocol.NEGOTIATION_ID_OPTION_INFO, protocol.NEGOTIATION_ID_OPTION_GO:
+			if optionHeader.Length > maximumOptionLength {
+				_, err := io.CopyN(io.Discard, conn, int64(optionHeader.Length)) // Discard the option's data
+				if err != nil {
+					return nil, err
 				}
+
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_TOO_BIG,
+					Length:     0,
+				}); err != nil {
+					return nil, err
+				}
+
+				break
 			}
 
-			if export == nil {
-				if length := int64(optionHeader.Length) - 4 - int64(exportNameLength); length > 0 { // Discard the option's data, minus the export name length and export name we've already read
-					_, err := io.CopyN(io.Discard, conn, length)
-					if err != nil {
-						return err
-					}
+			data := make([]byte, optionHeader.Length)
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return nil, err
+			}
+
+			exportName, informationRequests, err := parseInfoOption(data)
+			if err != nil {
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_INVALID,
+					Length:     0,
+				}); err != nil {
+					return nil, err
 				}
 
+				break
+			}
+
+			export, err = registry.lookup(exportName, s) // Don't fall back to an export selected by a previous option
+			if err != nil || export == nil {
 				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
 					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
 					ID:         optionHeader.ID,
 					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_UNKNOWN,
 					Length:     0,
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				break
 			}
 
-			size, err := export.Backend.Size()
+			exportSize, err := export.Backend.Size()
 			if err != nil {
-				return err
+				return nil, err
 			}
 
-			{
-				var informationRequestCount uint16
-				if err := binary.Read(conn, binary.BigEndian, &informationRequestCount); err != nil {
-					return err
+			size = exportSize
+
+			exportOptions, err = optionsForExport(export, options)
+			if err != nil {
+				return nil, err
+			}
+
+			if !authorize(conn, export, exportOptions) {
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_POLICY,
+					Length:     0,
+				}); err != nil {
+					return nil, err
 				}
 
-				_, err := io.CopyN(io.Discard, conn, 2*int64(informationRequestCount)) // Discard information requests (uint16s)
-				if err != nil {
-					return err
+				break
+			}
+
+			var sendName, sendDescription, sendBlockSize bool
+			for _, informationRequest := range informationRequests {
+				switch informationRequest {
+				case protocol.NEGOTIATION_TYPE_INFO_NAME:
+					sendName = true
+				case protocol.NEGOTIATION_TYPE_INFO_DESCRIPTION:
+					sendDescription = true
+				case protocol.NEGOTIATION_TYPE_INFO_BLOCKSIZE:
+					sendBlockSize = true
+					blockSizeRequested = true
 				}
 			}
 
-			{
-				transmissionFlags := uint16(0)
-				if options.SupportsMultiConn {
-					transmissionFlags = protocol.NEGOTIATION_REPLY_FLAGS_HAS_FLAGS | protocol.NEGOTIATION_REPLY_FLAGS_CAN_MULTI_CONN
+			if optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_GO && !blockSizeRequested && exportOptions.MinimumBlockSize > 1 { // Clients that don't request the block size constraints would assume that they can send unaligned requests
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_BLOCK_SIZE_REQD,
+					Length:     0,
+				}); err != nil {
+					return nil, err
 				}
 
+				break
+			}
+
+			{
 				info := &bytes.Buffer{}
 				if err := binary.Write(info, binary.BigEndian, protocol.NegotiationReplyInfo{
 					Type:              protocol.NEGOTIATION_TYPE_INFO_EXPORT,
 					Size:              uint64(size),
-					TransmissionFlags: transmissionFlags,
+					TransmissionFlags: transmissionFlags(export, exportOptions, structuredReplies),
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
@@ -166,24 +445,24 @@ n:
 					Type:       protocol.NEGOTIATION_TYPE_REPLY_INFO,
 					Length:     uint32(info.Len()),
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				if _, err := io.Copy(conn, info); err != nil {
-					return err
+					return nil, err
 				}
 			}
 
-			{
+			if sendName {
 				info := &bytes.Buffer{}
 				if err := binary.Write(info, binary.BigEndian, protocol.NegotiationReplyNameHeader{
 					Type: protocol.NEGOTIATION_TYPE_INFO_NAME,
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				if _, err := info.Write([]byte(exportName)); err != nil {
-					return err
+					return nil, err
 				}
 
 				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
@@ -192,24 +471,24 @@ n:
 					Type:       protocol.NEGOTIATION_TYPE_REPLY_INFO,
 					Length:     uint32(info.Len()),
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				if _, err := io.Copy(conn, info); err != nil {
-					return err
+					return nil, err
 				}
 			}
 
-			{
+			if sendDescription {
 				info := &bytes.Buffer{}
 				if err := binary.Write(info, binary.BigEndian, protocol.NegotiationReplyDescriptionHeader{
 					Type: protocol.NEGOTIATION_TYPE_INFO_DESCRIPTION,
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				if err := binary.Write(info, binary.BigEndian, []byte(export.Description)); err != nil {
-					return err
+					return nil, err
 				}
 
 				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
@@ -218,23 +497,23 @@ n:
 					Type:       protocol.NEGOTIATION_TYPE_REPLY_INFO,
 					Length:     uint32(info.Len()),
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				if _, err := io.Copy(conn, info); err != nil {
-					return err
+					return nil, err
 				}
 			}
 
-			{
+			if sendBlockSize {
 				info := &bytes.Buffer{}
 				if err := binary.Write(info, binary.BigEndian, protocol.NegotiationReplyBlockSize{
 					Type:               protocol.NEGOTIATION_TYPE_INFO_BLOCKSIZE,
-					MinimumBlockSize:   options.MinimumBlockSize,
-					PreferredBlockSize: options.PreferredBlockSize,
-					MaximumBlockSize:   options.MaximumBlockSize,
+					MinimumBlockSize:   exportOptions.MinimumBlockSize,
+					PreferredBlockSize: exportOptions.PreferredBlockSize,
+					MaximumBlockSize:   exportOptions.MaximumBlockSize,
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
@@ -243,11 +522,26 @@ n:
 					Type:       protocol.NEGOTIATION_TYPE_REPLY_INFO,
 					Length:     uint32(info.Len()),
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				if _, err := io.Copy(conn, info); err != nil {
-					return err
+					return nil, err
+				}
+			}
+
+			if optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_GO {
+				if err := registry.attach(export, s); err != nil {
+					if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+						ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+						ID:         optionHeader.ID,
+						Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_UNKNOWN,
+						Length:     0,
+					}); err != nil {
+						return nil, err
+					}
+
+					break
 				}
 			}
 
@@ -257,12 +551,75 @@ n:
 				Type:       protocol.NEGOTIATION_TYPE_REPLY_ACK,
 				Length:     0,
 			}); err != nil {
-				return err
+				return nil, err
 			}
 
 			if optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_GO {
+				if metaContextExportName != export.Name { // Meta contexts are only valid for the export they were selected for
+					baseAllocation = false
+				}
+
 				break n
 			}
+		case protocol.NEGOTIATION_ID_OPTION_EXPORT_NAME:
+			if optionHeader.Length > maximumOptionLength {
+				return nil, ErrUnknownExport // We can't reply with an error to `NBD_OPT_EXPORT_NAME`, so we can only disconnect
+			}
+
+			exportName := make([]byte, optionHeader.Length)
+			if _, err := io.ReadFull(conn, exportName); err != nil {
+				return nil, err
+			}
+
+			selectedExport, err := registry.lookup(string(exportName), s)
+			if err != nil {
+				return nil, err
+			}
+
+			if selectedExport == nil {
+				return nil, ErrUnknownExport
+			}
+
+			export = selectedExport
+
+			exportSize, err := export.Backend.Size()
+			if err != nil {
+				return nil, err
+			}
+
+			size = exportSize
+
+			exportOptions, err = optionsForExport(export, options)
+			if err != nil {
+				return nil, err
+			}
+
+			if !authorize(conn, export, exportOptions) {
+				return nil, ErrAccessDenied // We can't reply with an error to `NBD_OPT_EXPORT_NAME`, so we can only disconnect
+			}
+
+			if err := registry.attach(export, s); err != nil {
+				return nil, err
+			}
+
+			if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyExportName{
+				Size:              uint64(size),
+				TransmissionFlags: transmissionFlags(export, exportOptions, structuredReplies),
+			}); err != nil {
+				return nil, err
+			}
+
+			if clientFlags&protocol.NEGOTIATION_CLIENT_FLAG_NO_ZEROES == 0 {
+				if _, err := conn.Write(make([]byte, 124)); err != nil { // Send reserved zeroes
+					return nil, err
+				}
+			}
+
+			if metaContextExportName != export.Name {
+				baseAllocation = false
+			}
+
+			break n
 		case protocol.NEGOTIATION_ID_OPTION_ABORT:
 			if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
 				ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
@@ -270,23 +627,28 @@ n:
 				Type:       protocol.NEGOTIATION_TYPE_REPLY_ACK,
 				Length:     0,
 			}); err != nil {
-				return err
+				return nil, err
 			}
 
-			return nil
+			return nil, nil // The client aborted the negotiation
 		case protocol.NEGOTIATION_ID_OPTION_LIST:
 			{
 				info := &bytes.Buffer{}
 
-				for _, export := range exports {
-					exportName := []byte(export.Name)
+				names, err := registry.names()
+				if err != nil {
+					return nil, err
+				}
+
+				for _, name := range names {
+					exportName := []byte(name)
 
 					if err := binary.Write(info, binary.BigEndian, uint32(len(exportName))); err != nil {
-						return err
+						return nil, err
 					}
 
 					if err := binary.Write(info, binary.BigEndian, exportName); err != nil {
-						return err
+						return nil, err
 					}
 				}
 
@@ -296,11 +658,11 @@ n:
 					Type:       protocol.NEGOTIATION_TYPE_REPLY_SERVER,
 					Length:     uint32(info.Len()),
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				if _, err := io.Copy(conn, info); err != nil {
-					return err
+					return nil, err
 				}
 			}
 
@@ -310,119 +672,496 @@ n:
 				Type:       protocol.NEGOTIATION_TYPE_REPLY_ACK,
 				Length:     0,
 			}); err != nil {
-				return err
+				return nil, err
 			}
-		default:
-			_, err := io.CopyN(io.Discard, conn, int64(optionHeader.Length)) // Discard the unknown option's data
-			if err != nil {
-				return err
+		case protocol.NEGOTIATION_ID_OPTION_STARTTLS:
+			if options.TLSConfig == nil {
+				_, err := io.CopyN(io.Discard, conn, int64(optionHeader.Length)) // Discard the option's data
+				if err != nil {
+					return nil, err
+				}
+
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_UNSUPPORTED,
+					Length:     0,
+				}); err != nil {
+					return nil, err
+				}
+
+				break
+			}
+
+			if optionHeader.Length > 0 || tlsEstablished {
+				_, err := io.CopyN(io.Discard, conn, int64(optionHeader.Length)) // Discard the option's data; STARTTLS requests must not carry any and can only be sent once
+				if err != nil {
+					return nil, err
+				}
+
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_INVALID,
+					Length:     0,
+				}); err != nil {
+					return nil, err
+				}
+
+				break
 			}
 
 			if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
 				ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
 				ID:         optionHeader.ID,
-				Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_UNSUPPORTED,
+				Type:       protocol.NEGOTIATION_TYPE_REPLY_ACK,
 				Length:     0,
 			}); err != nil {
-				return err
+				return nil, err
 			}
-		}
-	}
 
-	// Transmission
-	b := []byte{}
-	for {
-		var requestHeader protocol.TransmissionRequestHeader
-		if err := binary.Read(conn, binary.BigEndian, &requestHeader); err != nil {
-			return err
-		}
+			tlsConn := tls.Server(conn, options.TLSConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, err
+			}
 
-		if requestHeader.RequestMagic != protocol.TRANSMISSION_MAGIC_REQUEST {
-			return ErrInvalidMagic
-		}
+			conn = tlsConn
+			tlsEstablished = true
+
+			// Options negotiated before the TLS handshake could have been tampered with, so we need to forget them
+			structuredReplies = false
+			extendedHeaders = false
+			baseAllocation = false
+			metaContextExportName = ""
+		case protocol.NEGOTIATION_ID_OPTION_STRUCTURED_REPLY, protocol.NEGOTIATION_ID_OPTION_EXTENDED_HEADERS:
+			if optionHeader.Length > 0 {
+				_, err := io.CopyN(io.Discard, conn, int64(optionHeader.Length)) // Discard the option's data; neither structured reply nor extended header requests carry any
+				if err != nil {
+					return nil, err
+				}
 
-		length := requestHeader.Length
-		if length > defaultMaximumRequestSize {
-			return ErrInvalidBlocksize
-		}
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_INVALID,
+					Length:     0,
+				}); err != nil {
+					return nil, err
+				}
 
-		if length != uint32(len(b)) {
-			b = make([]byte, length)
-		}
+				break
+			}
 
-		switch requestHeader.Type {
-		case protocol.TRANSMISSION_TYPE_REQUEST_READ:
-			if err := binary.Write(conn, binary.BigEndian, protocol.TransmissionReplyHeader{
-				ReplyMagic: protocol.TRANSMISSION_MAGIC_REPLY,
-				Error:      0,
-				Handle:     requestHeader.Handle,
-			}); err != nil {
-				return err
+			if optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_STRUCTURED_REPLY && extendedHeaders {
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_EXT_HEADER_REQD, // We can't go back to compact headers once extended headers have been negotiated
+					Length:     0,
+				}); err != nil {
+					return nil, err
+				}
+
+				break
 			}
 
-			n, err := export.Backend.ReadAt(b[:length], int64(requestHeader.Offset))
-			if err != nil {
-				return err
+			structuredReplies = true // Extended headers imply structured replies
+			if optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_EXTENDED_HEADERS {
+				extendedHeaders = true
 			}
 
-			if _, err := conn.Write(b[:n]); err != nil {
-				return err
+			if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+				ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+				ID:         optionHeader.ID,
+				Type:       protocol.NEGOTIATION_TYPE_REPLY_ACK,
+				Length:     0,
+			}); err != nil {
+				return nil, err
 			}
-		case protocol.TRANSMISSION_TYPE_REQUEST_WRITE:
-			if options.ReadOnly {
-				_, err := io.CopyN(io.Discard, conn, int64(requestHeader.Length)) // Discard the write command's data
+		case protocol.NEGOTIATION_ID_OPTION_LIST_META_CONTEXT, protocol.NEGOTIATION_ID_OPTION_SET_META_CONTEXT:
+			if optionHeader.Length > maximumOptionLength {
+				_, err := io.CopyN(io.Discard, conn, int64(optionHeader.Length)) // Discard the option's data
 				if err != nil {
-					return err
+					return nil, err
 				}
 
-				if err := binary.Write(conn, binary.BigEndian, protocol.TransmissionReplyHeader{
-					ReplyMagic: protocol.TRANSMISSION_MAGIC_REPLY,
-					Error:      protocol.TRANSMISSION_ERROR_EPERM,
-					Handle:     requestHeader.Handle,
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_TOO_BIG,
+					Length:     0,
 				}); err != nil {
-					return err
+					return nil, err
 				}
 
 				break
 			}
 
-			n, err := io.ReadAtLeast(conn, b[:length], int(requestHeader.Length))
-			if err != nil {
-				return err
+			data := make([]byte, optionHeader.Length)
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return nil, err
 			}
 
-			if _, err := export.Backend.WriteAt(b[:n], int64(requestHeader.Offset)); err != nil {
-				return err
+			exportName, queries, err := parseMetaContextOption(data)
+			if err != nil || (optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_SET_META_CONTEXT && !structuredReplies) { // Meta contexts can only be used with structured replies
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_INVALID,
+					Length:     0,
+				}); err != nil {
+					return nil, err
+				}
+
+				break
 			}
 
-			if err := binary.Write(conn, binary.BigEndian, protocol.TransmissionReplyHeader{
-				ReplyMagic: protocol.TRANSMISSION_MAGIC_REPLY,
-				Error:      0,
-				Handle:     requestHeader.Handle,
-			}); err != nil {
-				return err
+			metaContextExport, err := registry.lookup(exportName, s)
+			if err != nil || metaContextExport == nil {
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_UNKNOWN,
+					Length:     0,
+				}); err != nil {
+					return nil, err
+				}
+
+				break
+			}
+
+			selectBaseAllocation := false
+			if optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_LIST_META_CONTEXT && len(queries) == 0 {
+				selectBaseAllocation = true // Listing without any queries returns all available meta contexts
+			}
+
+			for _, query := range queries {
+				if query == protocol.NEGOTIATION_META_CONTEXT_BASE_ALLOCATION ||
+					(optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_LIST_META_CONTEXT && query == "base:") { // Listing allows querying all meta contexts in a namespace
+					selectBaseAllocation = true
+				}
 			}
-		case protocol.TRANSMISSION_TYPE_REQUEST_DISC:
-			if !options.ReadOnly {
-				if err := export.Backend.Sync(); err != nil {
-					return err
+
+			if selectBaseAllocation {
+				info := &bytes.Buffer{}
+				if err := binary.Write(info, binary.BigEndian, protocol.NegotiationReplyMetaContextHeader{
+					ID: metaContextIDBaseAllocation,
+				}); err != nil {
+					return nil, err
+				}
+
+				if _, err := info.Write([]byte(protocol.NEGOTIATION_META_CONTEXT_BASE_ALLOCATION)); err != nil {
+					return nil, err
+				}
+
+				if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+					ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+					ID:         optionHeader.ID,
+					Type:       protocol.NEGOTIATION_TYPE_REPLY_META_CONTEXT,
+					Length:     uint32(info.Len()),
+				}); err != nil {
+					return nil, err
+				}
+
+				if _, err := io.Copy(conn, info); err != nil {
+					return nil, err
 				}
 			}
 
-			return nil
+			if optionHeader.ID == protocol.NEGOTIATION_ID_OPTION_SET_META_CONTEXT {
+				baseAllocation = selectBaseAllocation
+				metaContextExportName = exportName
+			}
+
+			if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+				ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+				ID:         optionHeader.ID,
+				Type:       protocol.NEGOTIATION_TYPE_REPLY_ACK,
+				Length:     0,
+			}); err != nil {
+				return nil, err
+			}
 		default:
-			_, err := io.CopyN(io.Discard, conn, int64(requestHeader.Length)) // Discard the unknown command's data
+			_, err := io.CopyN(io.Discard, conn, int64(optionHeader.Length)) // Discard the unknown option's data
 			if err != nil {
-				return err
+				return nil, err
 			}
 
-			if err := binary.Write(conn, binary.BigEndian, protocol.TransmissionReplyHeader{
-				ReplyMagic: protocol.TRANSMISSION_MAGIC_REPLY,
-				Error:      protocol.TRANSMISSION_ERROR_EINVAL,
-				Handle:     requestHeader.Handle,
+			if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationReplyHeader{
+				ReplyMagic: protocol.NEGOTIATION_MAGIC_REPLY,
+				ID:         optionHeader.ID,
+				Type:       protocol.NEGOTIATION_TYPE_REPLY_ERR_UNSUPPORTED,
+				Length:     0,
 			}); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
+
+	t := &transmission{
+		conn:     conn,
+		export:   export,
+		readOnly: isReadOnly(export, exportOptions),
+		options:  exportOptions,
+
+		structuredReplies: structuredReplies,
+		extendedHeaders:   extendedHeaders,
+		baseAllocation:    baseAllocation,
+	}
+
+	return t, nil
+}
+
+func negotiateOldstyle(conn net.Conn, registry *Registry, s *session, options *Options) (*transmission, error) {
+	if options.TLSRequired {
+		return nil, ErrTLSRequired // The oldstyle handshake can't be upgraded to TLS
+	}
+
+	export, err := registry.lookup(options.OldstyleExportName, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if export == nil {
+		return nil, ErrUnknownExport
+	}
+
+	size, err := export.Backend.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	exportOptions, err := optionsForExport(export, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if !authorize(conn, export, exportOptions) {
+		return nil, ErrAccessDenied
+	}
+
+	if err := registry.attach(export, s); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(conn, binary.BigEndian, protocol.NegotiationOldstyleHeader{
+		OldstyleMagic:     protocol.NEGOTIATION_MAGIC_OLDSTYLE,
+		CliservMagic:      protocol.NEGOTIATION_MAGIC_CLISERV,
+		Size:              uint64(size),
+		TransmissionFlags: uint32(transmissionFlags(export, exportOptions, false)),
+	}); err != nil {
+		return nil, err
+	}
+
+	t := &transmission{
+		conn:     conn,
+		export:   export,
+		readOnly: isReadOnly(export, exportOptions),
+		options:  exportOptions,
+	}
+
+	return t, nil
+}
+
+// optionsForExport returns a copy of the options with the settings of the export applied
+func optionsForExport(export *Export, options *Options) (*Options, error) {
+	exportOptions := *options
+
+	if export.ReadOnly != nil {
+		exportOptions.ReadOnly = *export.ReadOnly
+	}
+
+	if export.MinimumBlockSize != 0 {
+		exportOptions.MinimumBlockSize = export.MinimumBlockSize
+	}
+
+	if export.PreferredBlockSize != 0 {
+		exportOptions.PreferredBlockSize = export.PreferredBlockSize
+	} else if exportOptions.PreferredBlockSize < exportOptions.MinimumBlockSize {
+		exportOptions.PreferredBlockSize = exportOptions.MinimumBlockSize
+	}
+
+	if export.MaximumBlockSize != 0 {
+		exportOptions.MaximumBlockSize = export.MaximumBlockSize
+	}
+
+	if uint64(exportOptions.MaximumBlockSize) > uint64(exportOptions.MaximumRequestSize) {
+		exportOptions.MaximumBlockSize = uint32(exportOptions.MaximumRequestSize) // We can't advertise block sizes that we reject as too large
+	}
+
+	if export.SupportsMultiConn != nil {
+		exportOptions.SupportsMultiConn = *export.SupportsMultiConn
+	}
+
+	if !isPowerOfTwo(exportOptions.MinimumBlockSize) ||
+		!isPowerOfTwo(exportOptions.PreferredBlockSize) ||
+		exportOptions.PreferredBlockSize < exportOptions.MinimumBlockSize ||
+		exportOptions.MaximumBlockSize < exportOptions.PreferredBlockSize {
+		return nil, ErrInvalidBlocksize
+	}
+
+	return &exportOptions, nil
+}
+
+// authorize calls the authorization hook and downgrades the export options to read-only if requested
+func authorize(conn net.Conn, export *Export, exportOptions *Options) bool {
+	if exportOptions.Authorize == nil {
+		return true
+	}
+
+	client := &Client{
+		RemoteAddr: conn.RemoteAddr(),
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		client.PeerCertificates = tlsConn.ConnectionState().PeerCertificates
+
+		conn = tlsConn.NetConn()
+	}
+
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		client.Credentials = peerCredentials(unixConn)
+	}
+
+	switch exportOptions.Authorize(client, export.Name) {
+	case AccessReadWrite:
+		return true
+	case AccessReadOnly:
+		exportOptions.ReadOnly = true
+
+		return true
+	default:
+		return false
+	}
+}
+
+func isReadOnly(export *Export, options *Options) bool {
+	return options.ReadOnly || backend.GetCapabilities(export.Backend).ReadOnly
+}
+
+func transmissionFlags(export *Export, options *Options, structuredReplies bool) uint16 {
+	capabilities := backend.GetCapabilities(export.Backend)
+
+	transmissionFlags := protocol.NEGOTIATION_REPLY_FLAGS_HAS_FLAGS
+	if capabilities.Flush {
+		transmissionFlags |= protocol.NEGOTIATION_REPLY_FLAGS_SEND_FLUSH
+	}
+
+	if capabilities.Rotational {
+		transmissionFlags |= protocol.NEGOTIATION_REPLY_FLAGS_ROTATIONAL
+	}
+
+	if options.SupportsMultiConn {
+		transmissionFlags |= protocol.NEGOTIATION_REPLY_FLAGS_CAN_MULTI_CONN
+	}
+
+	if capabilities.Cache {
+		transmissionFlags |= protocol.NEGOTIATION_REPLY_FLAGS_SEND_CACHE
+	}
+
+	if isReadOnly(export, options) {
+		transmissionFlags |= protocol.NEGOTIATION_REPLY_FLAGS_READ_ONLY
+	} else {
+		transmissionFlags |= protocol.NEGOTIATION_REPLY_FLAGS_SEND_WRITE_ZEROES | protocol.NEGOTIATION_REPLY_FLAGS_SEND_FAST_ZERO
+
+		if capabilities.Trim {
+			transmissionFlags |= protocol.NEGOTIATION_REPLY_FLAGS_SEND_TRIM
+		}
+
+		if capabilities.FUA {
+			transmissionFlags |= protocol.NEGOTIATION_REPLY_FLAGS_SEND_FUA
+		}
+
+		if capabilities.Resize {
+			transmissionFlags |= protocol.NEGOTIATION_REPLY_FLAGS_SEND_RESIZE
+		}
+	}
+
+	if structuredReplies {
+		transmissionFlags |= protocol.NEGOTIATION_REPLY_FLAGS_SEND_DF
+	}
+
+	return transmissionFlags
+}
+
+func isPowerOfTwo(v uint32) bool {
+	return v > 0 && v&(v-1) == 0
+}
+
+func parseInfoOption(data []byte) (string, []uint16, error) {
+	if len(data) < 4 {
+		return "", nil, ErrInvalidInfo
+	}
+
+	exportNameLength := binary.BigEndian.Uint32(data)
+	if uint64(exportNameLength) > uint64(len(data)-4) {
+		return "", nil, ErrInvalidInfo
+	}
+
+	exportName := string(data[4 : 4+exportNameLength])
+	data = data[4+exportNameLength:]
+
+	if len(data) < 2 {
+		return "", nil, ErrInvalidInfo
+	}
+
+	informationRequestCount := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+
+	if len(data) != 2*informationRequestCount {
+		return "", nil, ErrInvalidInfo
+	}
+
+	informationRequests := []uint16{}
+	for i := 0; i < informationRequestCount; i++ {
+		informationRequests = append(informationRequests, binary.BigEndian.Uint16(data[2*i:]))
+	}
+
+	return exportName, informationRequests, nil
+}
+
+func parseMetaContextOption(data []byte) (string, []string, error) {
+	next := func() (string, error) {
+		if len(data) < 4 {
+			return "", ErrInvalidMetaContext
+		}
+
+		length := binary.BigEndian.Uint32(data)
+		if uint64(length) > uint64(len(data)-4) {
+			return "", ErrInvalidMetaContext
+		}
+
+		value := string(data[4 : 4+length])
+		data = data[4+length:]
+
+		return value, nil
+	}
+
+	exportName, err := next()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(data) < 4 {
+		return "", nil, ErrInvalidMetaContext
+	}
+
+	queryCount := binary.BigEndian.Uint32(data)
+	data = data[4:]
+
+	queries := []string{}
+	for i := uint32(0); i < queryCount; i++ {
+		query, err := next()
+		if err != nil {
+			return "", nil, err
+		}
+
+		queries = append(queries, query)
+	}
+
+	if len(data) > 0 {
+		return "", nil, ErrInvalidMetaContext
+	}
+
+	return exportName, queries, nil
 }
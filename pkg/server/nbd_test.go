@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestOptionsForExportClampsMaximumBlockSize(t *testing.T) {
+	exportOptions, err := optionsForExport(&Export{Name: "default"}, &Options{
+		MinimumBlockSize:   1,
+		PreferredBlockSize: 4096,
+		MaximumBlockSize:   0xffffffff,
+		MaximumRequestSize: defaultMaximumRequestSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exportOptions.MaximumBlockSize != defaultMaximumRequestSize {
+		t.Fatalf("got maximum block size %v, expected %v", exportOptions.MaximumBlockSize, defaultMaximumRequestSize)
+	}
+}
+
+func TestOptionsForExportOverridesReadOnly(t *testing.T) {
+	writable, readOnly := false, true
+
+	for _, test := range []struct {
+		global   bool
+		export   *bool
+		expected bool
+	}{
+		{true, nil, true},
+		{true, &writable, false},
+		{false, nil, false},
+		{false, &readOnly, true},
+	} {
+		exportOptions, err := optionsForExport(&Export{Name: "default", ReadOnly: test.export}, &Options{
+			ReadOnly:           test.global,
+			MinimumBlockSize:   1,
+			PreferredBlockSize: 4096,
+			MaximumBlockSize:   defaultMaximumRequestSize,
+			MaximumRequestSize: defaultMaximumRequestSize,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exportOptions.ReadOnly != test.expected {
+			t.Fatalf("got read-only %v for global %v and export %v, expected %v", exportOptions.ReadOnly, test.global, test.export, test.expected)
+		}
+	}
+}
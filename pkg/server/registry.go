@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrExportExists  = errors.New("export already exists")
+	ErrExportRemoved = errors.New("export was removed")
+)
+
+type session struct {
+	cancel   context.CancelCauseFunc
+	export   *Export         // The export the session is attached to
+	resolved *resolvedExport // The resolved export the session holds a reference to
+}
+
+type resolvedExport struct {
+	name       string
+	export     *Export
+	references int
+}
+
+type RegistryHooks struct {
+	Resolve   func(name string) (*Export, error) // Called if a client asks for an export that isn't in the registry; return `nil` if it doesn't exist
+	List      func() ([]string, error)           // Called to list the names of the exports that can be resolved
+	OnRelease func(export *Export)               // Called once the last client of a resolved export has disconnected
+}
+
+// Registry is a set of exports that can be changed while clients are connected
+type Registry struct {
+	lock     sync.Mutex
+	exports  []*Export
+	resolved map[string]*resolvedExport
+	sessions map[*Export]map[*session]struct{}
+	hooks    *RegistryHooks
+}
+
+func NewRegistry(exports []*Export) *Registry {
+	return NewRegistryWithHooks(exports, nil)
+}
+
+func NewRegistryWithHooks(exports []*Export, hooks *RegistryHooks) *Registry {
+	if hooks == nil {
+		hooks = &RegistryHooks{}
+	}
+
+	return &Registry{
+		exports:  append([]*Export{}, exports...),
+		resolved: map[string]*resolvedExport{},
+		sessions: map[*Export]map[*session]struct{}{},
+		hooks:    hooks,
+	}
+}
+
+// Get returns the export with the name; exports that haven't been resolved yet aren't returned
+func (r *Registry) Get(name string) *Export {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, export := r.find(name); export != nil {
+		return export
+	}
+
+	if resolved, ok := r.resolved[name]; ok {
+		return resolved.export
+	}
+
+	return nil
+}
+
+// List returns the exports that were added to the registry
+func (r *Registry) List() []*Export {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]*Export{}, r.exports...)
+}
+
+func (r *Registry) Add(export *Export) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if i, _ := r.find(export.Name); i >= 0 {
+		return ErrExportExists
+	}
+
+	r.exports = append(r.exports, export)
+
+	return nil
+}
+
+// Remove removes the export from the registry so that new clients can't select it; if disconnect is set,
+// clients that are currently using the export are disconnected, otherwise they can continue to use it
+func (r *Registry) Remove(name string, disconnect bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	i, export := r.find(name)
+	if i < 0 {
+		return ErrUnknownExport
+	}
+
+	r.exports = append(r.exports[:i], r.exports[i+1:]...)
+
+	if disconnect {
+		r.disconnect(export)
+	}
+
+	return nil
+}
+
+// Replace replaces the export with the same name; if disconnect is set, clients that are currently using
+// the previous export are disconnected, otherwise they can continue to use it
+func (r *Registry) Replace(export *Export, disconnect bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	i, previous := r.find(export.Name)
+	if i < 0 {
+		return ErrUnknownExport
+	}
+
+	r.exports[i] = export
+
+	if disconnect {
+		r.disconnect(previous)
+	}
+
+	return nil
+}
+
+func (r *Registry) find(name string) (int, *Export) {
+	for i, export := range r.exports {
+		if export.Name == name {
+			return i, export
+		}
+	}
+
+	return -1, nil
+}
+
+func (r *Registry) disconnect(export *Export) {
+	for s := range r.sessions[export] {
+		s.cancel(ErrExportRemoved)
+	}
+}
+
+// lookup returns the export with the name and resolves it if it isn't in the registry; the session keeps
+// a reference to resolved exports until it looks up another export or is detached
+func (r *Registry) lookup(name string, s *session) (*Export, error) {
+	r.lock.Lock()
+
+	if s.resolved != nil && s.resolved.name == name {
+		r.lock.Unlock()
+
+		return s.resolved.export, nil
+	}
+
+	released := r.unreference(s)
+
+	if _, export := r.find(name); export != nil {
+		r.lock.Unlock()
+		r.release(released)
+
+		return export, nil
+	}
+
+	if resolved, ok := r.resolved[name]; ok {
+		resolved.references++
+		s.resolved = resolved
+
+		r.lock.Unlock()
+		r.release(released)
+
+		return resolved.export, nil
+	}
+
+	r.lock.Unlock()
+	r.release(released)
+
+	if r.hooks.Resolve == nil {
+		return nil, nil
+	}
+
+	export, err := r.hooks.Resolve(name) // Resolving can be slow, so we don't hold the lock
+	if err != nil || export == nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+
+	if resolved, ok := r.resolved[name]; ok { // Another client resolved the export in the meantime
+		resolved.references++
+		s.resolved = resolved
+
+		r.lock.Unlock()
+		r.release(export)
+
+		return resolved.export, nil
+	}
+
+	s.resolved = &resolvedExport{name, export, 1}
+	r.resolved[name] = s.resolved
+
+	r.lock.Unlock()
+
+	return export, nil
+}
+
+func (r *Registry) names() ([]string, error) {
+	r.lock.Lock()
+
+	names := []string{}
+	known := map[string]struct{}{}
+	for _, export := range r.exports {
+		names = append(names, export.Name)
+		known[export.Name] = struct{}{}
+	}
+
+	r.lock.Unlock()
+
+	if r.hooks.List == nil {
+		return names, nil
+	}
+
+	resolvable, err := r.hooks.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range resolvable {
+		if _, ok := known[name]; ok {
+			continue
+		}
+
+		names = append(names, name)
+		known[name] = struct{}{}
+	}
+
+	return names, nil
+}
+
+func (r *Registry) attach(export *Export, s *session) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if s.resolved == nil || s.resolved.export != export {
+		if _, current := r.find(export.Name); current != export {
+			return ErrExportRemoved // The export was removed or replaced while the client was negotiating
+		}
+	}
+
+	if r.sessions[export] == nil {
+		r.sessions[export] = map[*session]struct{}{}
+	}
+	r.sessions[export][s] = struct{}{}
+
+	s.export = export
+
+	return nil
+}
+
+func (r *Registry) detach(s *session) {
+	r.lock.Lock()
+
+	if s.export != nil {
+		delete(r.sessions[s.export], s)
+
+		if len(r.sessions[s.export]) == 0 {
+			delete(r.sessions, s.export)
+		}
+
+		s.export = nil
+	}
+
+	released := r.unreference(s)
+
+	r.lock.Unlock()
+
+	r.release(released)
+}
+
+// unreference drops the session's reference to its resolved export and returns the export if it is no longer used
+func (r *Registry) unreference(s *session) *Export {
+	if s.resolved == nil {
+		return nil
+	}
+
+	resolved := s.resolved
+	s.resolved = nil
+
+	resolved.references--
+	if resolved.references > 0 {
+		return nil
+	}
+
+	delete(r.resolved, resolved.name)
+
+	return resolved.export
+}
+
+func (r *Registry) release(export *Export) {
+	if export != nil && r.hooks.OnRelease != nil {
+		r.hooks.OnRelease(export)
+	}
+}
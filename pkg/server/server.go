@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/go-nbd/pkg/backend"
+)
+
+const (
+	minimumAcceptRetryDelay = 5 * time.Millisecond
+	maximumAcceptRetryDelay = time.Second
+)
+
+type ServerHooks struct {
+	OnConnect    func(conn net.Conn)
+	OnDisconnect func(conn net.Conn, err error)
+}
+
+type Server struct {
+	registry *Registry
+	options  *Options
+	hooks    *ServerHooks
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+
+	lock      sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	sessions  sync.WaitGroup
+}
+
+func NewServer(exports []*Export, options *Options, hooks *ServerHooks) *Server {
+	return NewServerWithRegistry(NewRegistry(exports), options, hooks)
+}
+
+func NewServerWithRegistry(registry *Registry, options *Options, hooks *ServerHooks) *Server {
+	if hooks == nil {
+		hooks = &ServerHooks{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Server{
+		registry: registry,
+		options:  options,
+		hooks:    hooks,
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		shutdown: make(chan struct{}),
+
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+// Registry returns the exports of the server, which can be changed while it is running
+func (s *Server) Registry() *Registry {
+	return s.registry
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+
+		return ErrServerClosed
+	}
+
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, l)
+		s.lock.Unlock()
+	}()
+
+	var retryDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() { // E.g. if we ran out of file descriptors, so we retry like `net/http` does
+				if retryDelay == 0 {
+					retryDelay = minimumAcceptRetryDelay
+				} else if retryDelay *= 2; retryDelay > maximumAcceptRetryDelay {
+					retryDelay = maximumAcceptRetryDelay
+				}
+
+				select {
+				case <-time.After(retryDelay):
+				case <-s.shutdown:
+				case <-s.ctx.Done():
+				}
+
+				continue
+			}
+
+			return err
+		}
+
+		retryDelay = 0
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+
+			_ = conn.Close()
+
+			return ErrServerClosed
+		}
+
+		s.conns[conn] = struct{}{}
+		s.sessions.Add(1)
+		s.lock.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return s.Serve(l)
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.sessions.Done()
+
+	if hook := s.hooks.OnConnect; hook != nil {
+		hook(conn)
+	}
+
+	var options *Options
+	if s.options != nil {
+		o := *s.options // Handle fills in the defaults, so every connection needs its own copy of the options
+		options = &o
+	}
+
+	err := handle(s.ctx, conn, s.registry, options, s.shutdown)
+
+	_ = conn.Close()
+
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.lock.Unlock()
+
+	if hook := s.hooks.OnDisconnect; hook != nil {
+		hook(conn, err)
+	}
+}
+
+func (s *Server) ActiveConnections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.conns)
+}
+
+func (s *Server) closeListeners() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+
+	errs := []error{}
+	for l := range s.listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+
+		delete(s.listeners, l)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Server) syncBackends() error {
+	errs := []error{}
+	for _, export := range s.registry.List() {
+		readOnly := s.options != nil && s.options.ReadOnly
+		if export.ReadOnly != nil {
+			readOnly = *export.ReadOnly
+		}
+
+		if readOnly || backend.GetCapabilities(export.Backend).ReadOnly {
+			continue
+		}
+
+		if err := export.Backend.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Shutdown stops accepting new connections, rejects new requests with NBD_ESHUTDOWN and waits for
+// clients to disconnect; if ctx is done before that, the remaining connections are closed forcefully
+func (s *Server) Shutdown(ctx context.Context) error {
+	listenerErr := s.closeListeners()
+
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.cancel()
+
+		<-done
+
+		err = ctx.Err()
+	}
+
+	s.cancel()
+
+	return errors.Join(err, listenerErr, s.syncBackends())
+}
+
+// Close stops accepting new connections and closes all active connections immediately
+func (s *Server) Close() error {
+	listenerErr := s.closeListeners()
+
+	s.cancel()
+	s.sessions.Wait()
+
+	return errors.Join(listenerErr, s.syncBackends())
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+
+		return nil, temporaryError{}
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestServeRetriesTemporaryAcceptErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connected := make(chan struct{}, 1)
+	srv := NewServer(nil, nil, &ServerHooks{
+		OnConnect: func(conn net.Conn) {
+			connected <- struct{}{}
+		},
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(&flakyListener{Listener: l})
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-connected:
+	case err := <-served:
+		t.Fatalf("got %v, expected the server to keep accepting connections", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the connection to be accepted")
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("got %v, expected %v", err, ErrServerClosed)
+	}
+}
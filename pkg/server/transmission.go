@@ -0,0 +1,984 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pojntfx/go-nbd/pkg/backend"
+	"github.com/pojntfx/go-nbd/pkg/protocol"
+)
+
+type request struct {
+	header   protocol.TransmissionExtendedRequestHeader // Compact request headers are converted to extended ones so that we can handle both the same way
+	data     []byte
+	received time.Time
+	inFlight int64 // Bytes that the request's payload or reply holds in memory
+
+	shutdown        bool
+	validationError uint32
+}
+
+type replyBuffer struct {
+	bytes.Buffer
+
+	errorType uint32 // The error that was sent to the client, if any
+	err       error  // The error of the backend that caused it, if any
+}
+
+func (r *replyBuffer) reset() {
+	r.Reset()
+
+	r.errorType = 0
+	r.err = nil
+}
+
+type pendingReply struct {
+	data     []byte
+	inFlight int64
+}
+
+// inFlightLimiter bounds the memory that the payloads of queued requests and replies use
+type inFlightLimiter struct {
+	lock      sync.Mutex
+	cond      *sync.Cond
+	available int64
+	maximum   int64
+}
+
+func newInFlightLimiter(maximum int64) *inFlightLimiter {
+	l := &inFlightLimiter{
+		available: maximum,
+		maximum:   maximum,
+	}
+	l.cond = sync.NewCond(&l.lock)
+
+	return l
+}
+
+func (l *inFlightLimiter) acquire(n int64) int64 {
+	if n > l.maximum {
+		n = l.maximum // Requests that are larger than the limit can still be executed on their own
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for l.available < n {
+		l.cond.Wait()
+	}
+
+	l.available -= n
+
+	return n
+}
+
+func (l *inFlightLimiter) release(n int64) {
+	if n == 0 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.available += n
+
+	l.cond.Broadcast()
+}
+
+type transmission struct {
+	ctx      context.Context
+	conn     net.Conn
+	export   *Export
+	readOnly bool
+	options  *Options
+	shutdown <-chan struct{}
+
+	structuredReplies bool
+	extendedHeaders   bool
+	baseAllocation    bool
+
+	inFlight *inFlightLimiter
+
+	errLock sync.Mutex
+	err     error
+}
+
+func (t *transmission) serve() error {
+	t.inFlight = newInFlightLimiter(int64(t.options.MaximumInFlight))
+
+	var (
+		requests = make(chan *request, t.options.QueueDepth)
+		replies  = make(chan pendingReply, t.options.QueueDepth)
+
+		workers    sync.WaitGroup
+		writerDone = make(chan struct{})
+	)
+
+	for i := 0; i < t.options.Workers; i++ {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			for req := range requests {
+				if t.failed() != nil {
+					t.inFlight.release(req.inFlight)
+
+					continue // Drain the remaining requests without executing them
+				}
+
+				reply, err := t.execute(req)
+				if err != nil {
+					t.inFlight.release(req.inFlight)
+					t.fail(err)
+
+					continue
+				}
+
+				if collector := t.options.Collector; collector != nil {
+					collector.RequestCompleted(t.conn, t.export, req.header.Type, req.header.Length, reply.errorType, time.Since(req.received))
+				}
+
+				replies <- pendingReply{reply.Bytes(), req.inFlight}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(writerDone)
+
+		for reply := range replies {
+			if t.failed() == nil { // Drain the remaining replies without sending them
+				if _, err := t.conn.Write(reply.data); err != nil {
+					t.fail(err)
+				}
+			}
+
+			t.inFlight.release(reply.inFlight)
+		}
+	}()
+
+	err := t.receive(requests)
+
+	close(requests)
+	workers.Wait()
+
+	close(replies)
+	<-writerDone
+
+	if t.ctx.Err() == nil { // If the context was cancelled, the errors are caused by us tearing down the connection
+		if err := t.failed(); err != nil {
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if !t.readOnly {
+		if err := t.export.Backend.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return t.ctx.Err()
+}
+
+func (t *transmission) fail(err error) {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+
+	if t.err != nil {
+		return
+	}
+
+	t.err = err
+
+	_ = t.conn.SetReadDeadline(time.Now()) // Unblock the receiver so that the connection can be torn down
+}
+
+func (t *transmission) failed() error {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+
+	return t.err
+}
+
+func (t *transmission) receive(requests chan<- *request) error {
+	for {
+		var requestHeader protocol.TransmissionExtendedRequestHeader
+		if t.extendedHeaders {
+			if err := binary.Read(t.conn, binary.BigEndian, &requestHeader); err != nil {
+				return err
+			}
+
+			if requestHeader.RequestMagic != protocol.TRANSMISSION_MAGIC_EXTENDED_REQUEST {
+				return ErrInvalidMagic
+			}
+		} else {
+			var compactRequestHeader protocol.TransmissionRequestHeader
+			if err := binary.Read(t.conn, binary.BigEndian, &compactRequestHeader); err != nil {
+				return err
+			}
+
+			if compactRequestHeader.RequestMagic != protocol.TRANSMISSION_MAGIC_REQUEST {
+				return ErrInvalidMagic
+			}
+
+			requestHeader = protocol.TransmissionExtendedRequestHeader{
+				RequestMagic: compactRequestHeader.RequestMagic,
+				CommandFlags: compactRequestHeader.CommandFlags,
+				Type:         compactRequestHeader.Type,
+				Handle:       compactRequestHeader.Handle,
+				Offset:       compactRequestHeader.Offset,
+				Length:       uint64(compactRequestHeader.Length),
+			}
+		}
+
+		req := &request{
+			header:   requestHeader,
+			received: time.Now(),
+		}
+
+		select {
+		case <-t.shutdown:
+			req.shutdown = true // Requests that we receive after the server started shutting down are rejected
+		default:
+		}
+
+		if requestHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_DISC {
+			return nil // In-flight requests are completed before the backend is synced and we disconnect
+		}
+
+		req.validationError = t.validate(requestHeader)
+
+		if (requestHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_READ && req.validationError == 0) ||
+			(requestHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_WRITE && req.validationError != protocol.TRANSMISSION_ERROR_EOVERFLOW) {
+			req.inFlight = t.inFlight.acquire(int64(requestHeader.Length)) // Wait until earlier payloads and replies have been released
+		}
+
+		if requestHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_WRITE { // Writes are the only requests with a payload, which we need to read before the next request's header
+			if req.validationError == protocol.TRANSMISSION_ERROR_EOVERFLOW {
+				if _, err := io.CopyN(io.Discard, t.conn, int64(requestHeader.Length)); err != nil { // Discard the payload instead of buffering it in memory
+					return err
+				}
+			} else {
+				req.data = make([]byte, requestHeader.Length)
+				if _, err := io.ReadFull(t.conn, req.data); err != nil {
+					return err
+				}
+			}
+		}
+
+		requests <- req
+	}
+}
+
+func (t *transmission) execute(req *request) (*replyBuffer, error) {
+	var (
+		requestHeader = req.header
+		reply         = &replyBuffer{}
+	)
+
+	if req.shutdown && requestHeader.Type != protocol.TRANSMISSION_TYPE_REQUEST_FLUSH { // Flushes are still allowed so that clients can persist their data before disconnecting
+		if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_ESHUTDOWN, ""); err != nil {
+			return nil, err
+		}
+
+		return reply, nil
+	}
+
+	if req.validationError != 0 {
+		if err := t.writeReplyError(reply, requestHeader, req.validationError, ""); err != nil {
+			return nil, err
+		}
+
+		return reply, nil
+	}
+
+	var (
+		executed    bool
+		dispatchErr error
+		requestErr  error
+	)
+	handler := chain(t.options.Interceptors, func(ctx context.Context, r *Request) error {
+		reply.reset() // Interceptors may retry requests, but we only send the last reply
+		executed = true
+		requestErr = nil
+
+		interceptedHeader := requestHeader
+		interceptedHeader.Type = r.Type
+		interceptedHeader.CommandFlags = r.Flags
+		interceptedHeader.Offset = r.Offset
+		interceptedHeader.Length = r.Length
+
+		if interceptedHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_WRITE {
+			interceptedHeader.Length = uint64(len(r.Data))
+		}
+
+		if interceptedHeader != requestHeader { // Interceptors might have changed the request so that it is no longer valid
+			if validationError := t.validate(interceptedHeader); validationError != 0 {
+				dispatchErr = t.writeReplyError(reply, interceptedHeader, validationError, "")
+			} else {
+				dispatchErr = t.dispatch(reply, interceptedHeader, r.Data)
+			}
+		} else {
+			dispatchErr = t.dispatch(reply, interceptedHeader, r.Data)
+		}
+
+		if dispatchErr != nil {
+			return dispatchErr
+		}
+
+		if reply.errorType != 0 {
+			requestErr = &RequestError{
+				Errno: reply.errorType,
+				Err:   reply.err,
+			}
+
+			return requestErr
+		}
+
+		return nil
+	})
+
+	err := handler(t.ctx, &Request{
+		Export: t.export,
+		Handle: requestHeader.Handle,
+
+		Type:   requestHeader.Type,
+		Flags:  requestHeader.CommandFlags,
+		Offset: requestHeader.Offset,
+		Length: requestHeader.Length,
+		Data:   req.data,
+	})
+	if dispatchErr != nil {
+		return nil, dispatchErr
+	}
+
+	switch {
+	case err != nil && !(requestErr != nil && errors.Is(err, requestErr)): // Keep the prepared reply if the interceptors passed on the error of the request
+		reply.reset() // Interceptors can also fail requests after they have been executed
+
+		if err := t.writeReplyError(reply, requestHeader, errorType(requestHeader.Type, err), err.Error()); err != nil {
+			return nil, err
+		}
+	case err == nil && !executed:
+		if requestHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_READ || requestHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_BLOCK_STATUS { // We can't reply to these without executing them
+			if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_EIO, "request was not executed"); err != nil {
+				return nil, err
+			}
+
+			break
+		}
+
+		if err := t.writeReply(reply, requestHeader); err != nil {
+			return nil, err
+		}
+	}
+
+	return reply, nil
+}
+
+func (t *transmission) dispatch(reply *replyBuffer, requestHeader protocol.TransmissionExtendedRequestHeader, data []byte) error {
+	switch requestHeader.Type {
+	case protocol.TRANSMISSION_TYPE_REQUEST_READ:
+		b := make([]byte, requestHeader.Length)
+
+		n, err := t.export.Backend.ReadAt(b, int64(requestHeader.Offset))
+		if err != nil && !(errors.Is(err, io.EOF) && n == len(b)) { // `io.ReaderAt` may return `io.EOF` alongside a full read at the end of the backend
+			if t.structuredReplies {
+				reply.err = err
+
+				if err := t.writeStructuredReplyError(reply, requestHeader, protocol.TRANSMISSION_TYPE_REPLY_ERROR_OFFSET, errorType(requestHeader.Type, err), err.Error(), requestHeader.Offset+uint64(n)); err != nil {
+					return err
+				}
+
+				break
+			}
+
+			if err := t.writeBackendReplyError(reply, requestHeader, err); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if t.structuredReplies {
+			if err := t.writeStructuredReplyRead(reply, requestHeader, b, requestHeader.CommandFlags&protocol.TRANSMISSION_FLAG_COMMAND_DF == 0); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if err := t.writeReply(reply, requestHeader); err != nil {
+			return err
+		}
+
+		if _, err := reply.Write(b); err != nil {
+			return err
+		}
+	case protocol.TRANSMISSION_TYPE_REQUEST_WRITE:
+		if t.readOnly {
+			if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_EPERM, ""); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		var err error
+		if writer, ok := t.export.Backend.(backend.ForceUnitAccessWriter); ok && isFUA(requestHeader) {
+			_, err = writer.WriteAtFUA(data, int64(requestHeader.Offset))
+		} else {
+			_, err = t.export.Backend.WriteAt(data, int64(requestHeader.Offset))
+			if err == nil && isFUA(requestHeader) {
+				err = t.export.Backend.Sync()
+			}
+		}
+
+		if err != nil {
+			if err := t.writeBackendReplyError(reply, requestHeader, err); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if err := t.writeReply(reply, requestHeader); err != nil {
+			return err
+		}
+	case protocol.TRANSMISSION_TYPE_REQUEST_FLUSH:
+		if !t.readOnly {
+			if err := t.export.Backend.Sync(); err != nil {
+				if err := t.writeBackendReplyError(reply, requestHeader, err); err != nil {
+					return err
+				}
+
+				break
+			}
+		}
+
+		if err := t.writeReply(reply, requestHeader); err != nil {
+			return err
+		}
+	case protocol.TRANSMISSION_TYPE_REQUEST_TRIM:
+		if t.readOnly {
+			if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_EPERM, ""); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		trimmer, ok := t.export.Backend.(backend.Trimmer)
+		if !ok {
+			if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_EINVAL, ""); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		err := trimmer.Trim(int64(requestHeader.Offset), int64(requestHeader.Length))
+		if err == nil && isFUA(requestHeader) {
+			err = t.export.Backend.Sync()
+		}
+
+		if err != nil {
+			if err := t.writeBackendReplyError(reply, requestHeader, err); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if err := t.writeReply(reply, requestHeader); err != nil {
+			return err
+		}
+	case protocol.TRANSMISSION_TYPE_REQUEST_WRITE_ZEROES:
+		if t.readOnly {
+			if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_EPERM, ""); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		var (
+			noHole   = requestHeader.CommandFlags&protocol.TRANSMISSION_FLAG_COMMAND_NO_HOLE != 0
+			fastZero = requestHeader.CommandFlags&protocol.TRANSMISSION_FLAG_COMMAND_FAST_ZERO != 0
+		)
+
+		err := backend.ErrUnsupported
+		if zeroer, ok := t.export.Backend.(backend.Zeroer); ok {
+			err = zeroer.Zero(int64(requestHeader.Offset), int64(requestHeader.Length), noHole)
+		}
+
+		if errors.Is(err, backend.ErrUnsupported) {
+			if fastZero { // Writing zeroes isn't faster than a regular write, so we need to let the client fall back to writing them itself
+				if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_ENOTSUP, ""); err != nil {
+					return err
+				}
+
+				break
+			}
+
+			err = writeZeroes(t.export.Backend, int64(requestHeader.Offset), int64(requestHeader.Length))
+		}
+
+		if err == nil && isFUA(requestHeader) {
+			err = t.export.Backend.Sync()
+		}
+
+		if err != nil {
+			if err := t.writeBackendReplyError(reply, requestHeader, err); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if err := t.writeReply(reply, requestHeader); err != nil {
+			return err
+		}
+	case protocol.TRANSMISSION_TYPE_REQUEST_CACHE:
+		if prefetcher, ok := t.export.Backend.(backend.Prefetcher); ok {
+			if err := prefetcher.Prefetch(int64(requestHeader.Offset), int64(requestHeader.Length)); err != nil {
+				if err := t.writeBackendReplyError(reply, requestHeader, err); err != nil {
+					return err
+				}
+
+				break
+			}
+		}
+
+		if err := t.writeReply(reply, requestHeader); err != nil {
+			return err
+		}
+	case protocol.TRANSMISSION_TYPE_REQUEST_RESIZE:
+		if t.readOnly {
+			if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_EPERM, ""); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		resizer, ok := t.export.Backend.(backend.Resizer)
+		if !ok || requestHeader.Offset > math.MaxInt64 || requestHeader.Offset%uint64(t.options.MinimumBlockSize) != 0 { // The new size is sent in the offset field
+			if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_EINVAL, ""); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if err := resizer.Resize(int64(requestHeader.Offset)); err != nil {
+			if err := t.writeBackendReplyError(reply, requestHeader, err); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if err := t.writeReply(reply, requestHeader); err != nil {
+			return err
+		}
+	case protocol.TRANSMISSION_TYPE_REQUEST_BLOCK_STATUS:
+		if !t.baseAllocation || requestHeader.Length == 0 { // Block status replies must contain at least one descriptor
+			if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_EINVAL, ""); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		extents := []backend.Extent{{Length: int64(requestHeader.Length)}} // Without support from the backend, we report the entire region as allocated
+		if reporter, ok := t.export.Backend.(backend.ExtentReporter); ok {
+			reportedExtents, err := reporter.Extents(int64(requestHeader.Offset), int64(requestHeader.Length))
+			if err != nil {
+				if err := t.writeBackendReplyError(reply, requestHeader, err); err != nil {
+					return err
+				}
+
+				break
+			}
+
+			extents = reportedExtents
+		}
+
+		if len(extents) == 0 {
+			if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_EINVAL, ""); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if requestHeader.CommandFlags&protocol.TRANSMISSION_FLAG_COMMAND_REQ_ONE != 0 {
+			extents = extents[:1]
+		}
+
+		if err := t.writeStructuredReplyBlockStatus(reply, requestHeader, metaContextIDBaseAllocation, extents); err != nil {
+			return err
+		}
+	default:
+		if err := t.writeReplyError(reply, requestHeader, protocol.TRANSMISSION_ERROR_EINVAL, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *transmission) validate(requestHeader protocol.TransmissionExtendedRequestHeader) uint32 {
+	switch requestHeader.Type {
+	case protocol.TRANSMISSION_TYPE_REQUEST_READ,
+		protocol.TRANSMISSION_TYPE_REQUEST_WRITE,
+		protocol.TRANSMISSION_TYPE_REQUEST_TRIM,
+		protocol.TRANSMISSION_TYPE_REQUEST_WRITE_ZEROES,
+		protocol.TRANSMISSION_TYPE_REQUEST_CACHE,
+		protocol.TRANSMISSION_TYPE_REQUEST_BLOCK_STATUS:
+	default:
+		return 0 // Flushes and unknown commands don't address a region of the export
+	}
+
+	var (
+		offset = requestHeader.Offset
+		length = requestHeader.Length
+	)
+
+	if requestHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_READ || requestHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_WRITE {
+		if length > uint64(t.options.MaximumBlockSize) { // Only the payload of reads and writes is limited by the maximum block size
+			return protocol.TRANSMISSION_ERROR_EOVERFLOW
+		}
+	}
+
+	backendSize, err := t.export.Backend.Size() // Other connections to the export can resize it at any time, so we don't cache the size
+	if err != nil || backendSize < 0 {
+		return protocol.TRANSMISSION_ERROR_EIO
+	}
+
+	size := uint64(backendSize)
+	if offset > size || length > size-offset {
+		if requestHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_WRITE || requestHeader.Type == protocol.TRANSMISSION_TYPE_REQUEST_WRITE_ZEROES {
+			return protocol.TRANSMISSION_ERROR_ENOSPC
+		}
+
+		return protocol.TRANSMISSION_ERROR_EINVAL
+	}
+
+	minimumBlockSize := uint64(t.options.MinimumBlockSize)
+	if offset%minimumBlockSize != 0 || (length%minimumBlockSize != 0 && offset+length != size) { // The last block of the export may be shorter than the minimum block size
+		return protocol.TRANSMISSION_ERROR_EINVAL
+	}
+
+	return 0
+}
+
+func (t *transmission) writeBackendReplyError(reply *replyBuffer, requestHeader protocol.TransmissionExtendedRequestHeader, err error) error {
+	reply.err = err
+
+	return t.writeReplyError(reply, requestHeader, errorType(requestHeader.Type, err), err.Error())
+}
+
+func isFUA(requestHeader protocol.TransmissionExtendedRequestHeader) bool {
+	return requestHeader.CommandFlags&protocol.TRANSMISSION_FLAG_COMMAND_FUA != 0
+}
+
+func errorType(requestType uint16, err error) uint32 {
+	var requestErr *RequestError
+
+	switch {
+	case errors.As(err, &requestErr):
+		return requestErr.Errno
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.ErrShortWrite):
+		if requestType == protocol.TRANSMISSION_TYPE_REQUEST_READ || requestType == protocol.TRANSMISSION_TYPE_REQUEST_CACHE || requestType == protocol.TRANSMISSION_TYPE_REQUEST_BLOCK_STATUS {
+			return protocol.TRANSMISSION_ERROR_EINVAL // Reading past the end of the backend
+		}
+
+		return protocol.TRANSMISSION_ERROR_ENOSPC // Writing past the end of the backend
+	case errors.Is(err, backend.ErrUnsupported), errors.Is(err, syscall.ENOTSUP), errors.Is(err, syscall.EOPNOTSUPP):
+		return protocol.TRANSMISSION_ERROR_ENOTSUP
+	case errors.Is(err, fs.ErrPermission), errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EROFS):
+		return protocol.TRANSMISSION_ERROR_EPERM
+	case errors.Is(err, syscall.ENOMEM):
+		return protocol.TRANSMISSION_ERROR_ENOMEM
+	case errors.Is(err, backend.ErrInvalidOffset), errors.Is(err, backend.ErrInvalidSize), errors.Is(err, syscall.EINVAL):
+		return protocol.TRANSMISSION_ERROR_EINVAL
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, syscall.EFBIG):
+		return protocol.TRANSMISSION_ERROR_ENOSPC
+	case errors.Is(err, syscall.EOVERFLOW):
+		return protocol.TRANSMISSION_ERROR_EOVERFLOW
+	case errors.Is(err, syscall.ESHUTDOWN):
+		return protocol.TRANSMISSION_ERROR_ESHUTDOWN
+	default:
+		return protocol.TRANSMISSION_ERROR_EIO
+	}
+}
+
+func writeZeroes(b backend.Backend, off int64, length int64) error {
+	blockSize := int64(zeroWriteBlockSize)
+	if length < blockSize {
+		blockSize = length
+	}
+
+	zeroes := make([]byte, blockSize)
+	for length > 0 {
+		chunk := zeroes
+		if length < int64(len(chunk)) {
+			chunk = chunk[:length]
+		}
+
+		n, err := b.WriteAt(chunk, off)
+		if err != nil {
+			return err
+		}
+
+		off += int64(n)
+		length -= int64(n)
+	}
+
+	return nil
+}
+
+func (t *transmission) writeReply(conn io.Writer, requestHeader protocol.TransmissionExtendedRequestHeader) error {
+	if t.extendedHeaders { // Simple replies can't be used with extended headers
+		return t.writeStructuredReplyHeader(conn, requestHeader, protocol.TRANSMISSION_FLAG_REPLY_DONE, protocol.TRANSMISSION_TYPE_REPLY_NONE, 0)
+	}
+
+	return binary.Write(conn, binary.BigEndian, protocol.TransmissionReplyHeader{
+		ReplyMagic: protocol.TRANSMISSION_MAGIC_REPLY,
+		Error:      0,
+		Handle:     requestHeader.Handle,
+	})
+}
+
+func (t *transmission) writeReplyError(reply *replyBuffer, requestHeader protocol.TransmissionExtendedRequestHeader, errorType uint32, message string) error {
+	if t.structuredReplies {
+		return t.writeStructuredReplyError(reply, requestHeader, protocol.TRANSMISSION_TYPE_REPLY_ERROR, errorType, message, 0)
+	}
+
+	reply.errorType = errorType
+
+	return binary.Write(reply, binary.BigEndian, protocol.TransmissionReplyHeader{
+		ReplyMagic: protocol.TRANSMISSION_MAGIC_REPLY,
+		Error:      errorType,
+		Handle:     requestHeader.Handle,
+	})
+}
+
+func (t *transmission) writeStructuredReplyHeader(conn io.Writer, requestHeader protocol.TransmissionExtendedRequestHeader, flags uint16, replyType uint16, length uint64) error {
+	if t.extendedHeaders {
+		return binary.Write(conn, binary.BigEndian, protocol.TransmissionExtendedReplyHeader{
+			ReplyMagic: protocol.TRANSMISSION_MAGIC_EXTENDED_REPLY,
+			Flags:      flags,
+			Type:       replyType,
+			Handle:     requestHeader.Handle,
+			Offset:     requestHeader.Offset,
+			Length:     length,
+		})
+	}
+
+	return binary.Write(conn, binary.BigEndian, protocol.TransmissionStructuredReplyHeader{
+		ReplyMagic: protocol.TRANSMISSION_MAGIC_STRUCTURED_REPLY,
+		Flags:      flags,
+		Type:       replyType,
+		Handle:     requestHeader.Handle,
+		Length:     uint32(length),
+	})
+}
+
+func (t *transmission) writeStructuredReplyRead(conn io.Writer, requestHeader protocol.TransmissionExtendedRequestHeader, data []byte, fragment bool) error {
+	if len(data) == 0 {
+		return t.writeStructuredReplyHeader(conn, requestHeader, protocol.TRANSMISSION_FLAG_REPLY_DONE, protocol.TRANSMISSION_TYPE_REPLY_NONE, 0)
+	}
+
+	isHole := func(start int) bool {
+		if !fragment {
+			return false // If the client doesn't allow fragmenting the reply, we need to send all data in a single chunk
+		}
+
+		end := start + holeDetectionBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		return bytes.Equal(data[start:end], zeroBlock[:end-start])
+	}
+
+	for start := 0; start < len(data); {
+		hole := isHole(start)
+
+		end := start + holeDetectionBlockSize
+		for end < len(data) && isHole(end) == hole {
+			end += holeDetectionBlockSize
+		}
+
+		if end > len(data) {
+			end = len(data)
+		}
+
+		flags := uint16(0)
+		if end == len(data) {
+			flags = protocol.TRANSMISSION_FLAG_REPLY_DONE
+		}
+
+		if hole {
+			if err := t.writeStructuredReplyHeader(conn, requestHeader, flags, protocol.TRANSMISSION_TYPE_REPLY_OFFSET_HOLE, uint64(binary.Size(protocol.TransmissionStructuredReplyOffsetHole{}))); err != nil {
+				return err
+			}
+
+			if err := binary.Write(conn, binary.BigEndian, protocol.TransmissionStructuredReplyOffsetHole{
+				Offset: requestHeader.Offset + uint64(start),
+				Length: uint32(end - start),
+			}); err != nil {
+				return err
+			}
+		} else {
+			if err := t.writeStructuredReplyHeader(conn, requestHeader, flags, protocol.TRANSMISSION_TYPE_REPLY_OFFSET_DATA, uint64(8+end-start)); err != nil { // Offset (uint64) and data
+				return err
+			}
+
+			if err := binary.Write(conn, binary.BigEndian, requestHeader.Offset+uint64(start)); err != nil {
+				return err
+			}
+
+			if _, err := conn.Write(data[start:end]); err != nil {
+				return err
+			}
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+func (t *transmission) writeStructuredReplyBlockStatus(conn io.Writer, requestHeader protocol.TransmissionExtendedRequestHeader, contextID uint32, extents []backend.Extent) error {
+	var (
+		length      = int64(requestHeader.Length)
+		descriptors = &bytes.Buffer{}
+		count       = uint32(0)
+	)
+	for _, extent := range extents {
+		if length <= 0 {
+			break
+		}
+
+		if extent.Length <= 0 {
+			continue
+		}
+
+		if extent.Length > length {
+			extent.Length = length
+		}
+
+		status := uint32(0)
+		if extent.Hole {
+			status |= protocol.TRANSMISSION_STATE_BASE_ALLOCATION_HOLE
+		}
+
+		if extent.Zero {
+			status |= protocol.TRANSMISSION_STATE_BASE_ALLOCATION_ZERO
+		}
+
+		if t.extendedHeaders {
+			if err := binary.Write(descriptors, binary.BigEndian, protocol.TransmissionStructuredReplyBlockStatusExtDescriptor{
+				Length: uint64(extent.Length),
+				Status: uint64(status),
+			}); err != nil {
+				return err
+			}
+		} else {
+			if err := binary.Write(descriptors, binary.BigEndian, protocol.TransmissionStructuredReplyBlockStatusDescriptor{
+				Length: uint32(extent.Length),
+				Status: status,
+			}); err != nil {
+				return err
+			}
+		}
+
+		count++
+		length -= extent.Length
+	}
+
+	payload := &bytes.Buffer{}
+	replyType := protocol.TRANSMISSION_TYPE_REPLY_BLOCK_STATUS
+	if t.extendedHeaders {
+		replyType = protocol.TRANSMISSION_TYPE_REPLY_BLOCK_STATUS_EXT
+
+		if err := binary.Write(payload, binary.BigEndian, protocol.TransmissionStructuredReplyBlockStatusExtHeader{
+			ContextID:       contextID,
+			DescriptorCount: count,
+		}); err != nil {
+			return err
+		}
+	} else {
+		if err := binary.Write(payload, binary.BigEndian, protocol.TransmissionStructuredReplyBlockStatusHeader{
+			ContextID: contextID,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.Copy(payload, descriptors); err != nil {
+		return err
+	}
+
+	if err := t.writeStructuredReplyHeader(conn, requestHeader, protocol.TRANSMISSION_FLAG_REPLY_DONE, replyType, uint64(payload.Len())); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(conn, payload)
+
+	return err
+}
+
+func (t *transmission) writeStructuredReplyError(reply *replyBuffer, requestHeader protocol.TransmissionExtendedRequestHeader, replyType uint16, errorType uint32, message string, offset uint64) error {
+	if len(message) > maximumErrorMessageLength {
+		message = message[:maximumErrorMessageLength]
+	}
+
+	length := binary.Size(protocol.TransmissionStructuredReplyErrorHeader{}) + len(message)
+	if replyType == protocol.TRANSMISSION_TYPE_REPLY_ERROR_OFFSET {
+		length += 8 // Offset (uint64)
+	}
+
+	reply.errorType = errorType
+
+	if err := t.writeStructuredReplyHeader(reply, requestHeader, protocol.TRANSMISSION_FLAG_REPLY_DONE, replyType, uint64(length)); err != nil {
+		return err
+	}
+
+	if err := binary.Write(reply, binary.BigEndian, protocol.TransmissionStructuredReplyErrorHeader{
+		Error:         errorType,
+		MessageLength: uint16(len(message)),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := reply.Write([]byte(message)); err != nil {
+		return err
+	}
+
+	if replyType == protocol.TRANSMISSION_TYPE_REPLY_ERROR_OFFSET {
+		if err := binary.Write(reply, binary.BigEndian, offset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pojntfx/go-nbd/pkg/backend"
+	"github.com/pojntfx/go-nbd/pkg/protocol"
+)
+
+func TestResizeIsSeenByOtherConnections(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "export"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := file.Truncate(1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	b := backend.NewFileBackend(file) // Unlike memory, files grow if they are written past their end
+
+	resizing := connectWithOptions(t, b, &Options{})
+	writing := connectWithOptions(t, b, &Options{})
+
+	if reply := sendRequestAt(t, resizing, protocol.TRANSMISSION_TYPE_REQUEST_RESIZE, 1, 4096, nil); reply.Error != 0 {
+		t.Fatalf("got error %v, expected success", reply.Error)
+	}
+
+	if reply := sendRequestAt(t, writing, protocol.TRANSMISSION_TYPE_REQUEST_WRITE, 1, 512*1024, make([]byte, 512)); reply.Error != protocol.TRANSMISSION_ERROR_ENOSPC {
+		t.Fatalf("got error %v, expected %v", reply.Error, protocol.TRANSMISSION_ERROR_ENOSPC)
+	}
+
+	if size, err := b.Size(); err != nil || size != 4096 {
+		t.Fatalf("got size %v (%v), expected 4096", size, err)
+	}
+}